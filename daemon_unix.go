@@ -0,0 +1,73 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+/* set in the detached child, holds number of the descriptor to report mount status */
+const daemonEnv = "SS3FS_DAEMON_FD"
+
+/* start detached copy of ourselves and wait until it mounts the bucket or dies */
+func daemonize() int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mount.ss3fs: can't find executable, error %v\n", err)
+		return exitSystem
+	}
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mount.ss3fs: can't create pipe, error %v\n", err)
+		return exitSystem
+	}
+	defer rd.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	/* keep argv[0], so child recognizes helper mode */
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = append(os.Environ(), daemonEnv+"=3")
+	cmd.ExtraFiles = []*os.File{wr}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	wr.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mount.ss3fs: can't start daemon, error %v\n", err)
+		return exitSystem
+	}
+	status := make([]byte, 1)
+	n, _ := rd.Read(status)
+	if n == 1 {
+		/* mounted, daemon keeps serving on its own */
+		cmd.Process.Release()
+		return exitOk
+	}
+	/* pipe closed without status, daemon failed before mount */
+	cmd.Wait()
+	return exitMountFailure
+}
+
+/* in the daemon returns callback, that reports successful mount to the parent */
+/* returns nil in any other process */
+func daemonReady() func() {
+	if os.Getenv(daemonEnv) != "3" {
+		return nil
+	}
+	os.Unsetenv(daemonEnv)
+	status := os.NewFile(3, "mount-status")
+	/* parent leaves after mount, don't die writing into its stdout or stderr */
+	signal.Ignore(syscall.SIGPIPE)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			status.Write([]byte{0})
+			status.Close()
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+/* there is no mount(8) on windows, helper can only run in foreground */
+func daemonize() int {
+	fmt.Fprintf(os.Stderr, "mount.ss3fs: daemon mode isn't supported on windows\n")
+	return exitUsage
+}
+
+func daemonReady() func() {
+	return nil
+}
@@ -0,0 +1,419 @@
+package posixtest
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+)
+
+/* all features in order of report */
+var Features = []Feature{
+	{Name: "open_flags", Checks: []Check{
+		{"excl", func(env *Env) error {
+			path := env.path("f")
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			file.Close()
+			_, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			return expectErrno(err, syscall.EEXIST)
+		}},
+		{"trunc", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, "hello"); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(path, os.O_TRUNC|os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			file.Close()
+			return expectSize(path, 0)
+		}},
+		{"append", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, "ab"); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			_, err = file.WriteString("cd")
+			file.Close()
+			if err != nil {
+				return err
+			}
+			return expectContent(path, []byte("abcd"))
+		}},
+		{"rdonly_write", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, "data"); err != nil {
+				return err
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = file.WriteString("x")
+			return expectErrno(err, syscall.EBADF)
+		}},
+		{"missing", func(env *Env) error {
+			_, err := os.Open(env.path("f"))
+			return expectErrno(err, syscall.ENOENT)
+		}},
+	}},
+	{Name: "rename", Checks: []Check{
+		{"replace", func(env *Env) error {
+			if err := writeFile(env.path("a"), "first"); err != nil {
+				return err
+			}
+			if err := writeFile(env.path("b"), "second"); err != nil {
+				return err
+			}
+			if err := os.Rename(env.path("a"), env.path("b")); err != nil {
+				return err
+			}
+			if err := expectMissing(env.path("a")); err != nil {
+				return err
+			}
+			return expectContent(env.path("b"), []byte("first"))
+		}},
+		{"self", func(env *Env) error {
+			if err := writeFile(env.path("a"), "data"); err != nil {
+				return err
+			}
+			if err := os.Rename(env.path("a"), env.path("a")); err != nil {
+				return err
+			}
+			return expectContent(env.path("a"), []byte("data"))
+		}},
+		{"missing", func(env *Env) error {
+			err := os.Rename(env.path("a"), env.path("b"))
+			return expectErrno(err, syscall.ENOENT)
+		}},
+		{"dir_into_itself", func(env *Env) error {
+			if err := os.Mkdir(env.path("d"), 0755); err != nil {
+				return err
+			}
+			err := syscall.Rename(env.path("d"), env.path("d")+"/sub")
+			return expectErrno(err, syscall.EINVAL)
+		}},
+		{"file_over_dir", func(env *Env) error {
+			if err := os.Mkdir(env.path("d"), 0755); err != nil {
+				return err
+			}
+			if err := writeFile(env.path("f"), "data"); err != nil {
+				return err
+			}
+			/* os.Rename refuses to replace directories itself */
+			err := syscall.Rename(env.path("f"), env.path("d"))
+			return expectErrno(err, syscall.EISDIR)
+		}},
+	}},
+	{Name: "unlink_open", Checks: []Check{
+		{"read", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, "data"); err != nil {
+				return err
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			if err := expectMissing(path); err != nil {
+				return err
+			}
+			data, err := readAt(file, 10, 0)
+			if err != nil {
+				return err
+			}
+			if string(data) != "data" {
+				return fmt.Errorf("%w: read %q from unlinked file", ErrMismatch, data)
+			}
+			return nil
+		}},
+		{"write", func(env *Env) error {
+			path := env.path("f")
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			if _, err := file.WriteAt([]byte("data"), 0); err != nil {
+				return err
+			}
+			data, err := readAt(file, 10, 0)
+			if err != nil {
+				return err
+			}
+			if string(data) != "data" {
+				return fmt.Errorf("%w: read %q from unlinked file", ErrMismatch, data)
+			}
+			return nil
+		}},
+	}},
+	{Name: "sparse", Checks: []Check{
+		{"hole", func(env *Env) error {
+			path := env.path("f")
+			file, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			_, err = file.WriteAt([]byte("x"), 1<<16)
+			file.Close()
+			if err != nil {
+				return err
+			}
+			return expectContent(path, append(make([]byte, 1<<16), 'x'))
+		}},
+		{"overwrite_middle", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, "abcdef"); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			_, err = file.WriteAt([]byte("X"), 2)
+			file.Close()
+			if err != nil {
+				return err
+			}
+			return expectContent(path, []byte("abXdef"))
+		}},
+	}},
+	{Name: "truncate", Checks: []Check{
+		{"shrink", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, "abcdef"); err != nil {
+				return err
+			}
+			if err := os.Truncate(path, 3); err != nil {
+				return err
+			}
+			return expectContent(path, []byte("abc"))
+		}},
+		{"extend", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, "abc"); err != nil {
+				return err
+			}
+			if err := os.Truncate(path, 6); err != nil {
+				return err
+			}
+			return expectContent(path, []byte("abc\x00\x00\x00"))
+		}},
+		{"ftruncate", func(env *Env) error {
+			path := env.path("f")
+			file, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if _, err := file.WriteString("abcdef"); err != nil {
+				return err
+			}
+			if err := file.Truncate(2); err != nil {
+				return err
+			}
+			data, err := readAt(file, 10, 0)
+			if err != nil {
+				return err
+			}
+			if string(data) != "ab" {
+				return fmt.Errorf("%w: read %q after ftruncate", ErrMismatch, data)
+			}
+			return nil
+		}},
+		{"negative", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, "abc"); err != nil {
+				return err
+			}
+			return expectErrno(os.Truncate(path, -1), syscall.EINVAL)
+		}},
+	}},
+	{Name: "mtime", Checks: []Check{
+		{"write", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, "abc"); err != nil {
+				return err
+			}
+			return expectMtimeUpdated(path, func() error {
+				return writeFile(path, "def")
+			})
+		}},
+		{"truncate", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, "abc"); err != nil {
+				return err
+			}
+			return expectMtimeUpdated(path, func() error {
+				return os.Truncate(path, 1)
+			})
+		}},
+		{"utimes", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, "abc"); err != nil {
+				return err
+			}
+			mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				return err
+			}
+			stat, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if !stat.ModTime().Equal(mtime) {
+				return fmt.Errorf("%w: mtime is %v, want %v", ErrMismatch, stat.ModTime(), mtime)
+			}
+			return nil
+		}},
+	}},
+	{Name: "readdir", Checks: []Check{
+		{"created_removed", func(env *Env) error {
+			want := []string{}
+			for i := 0; i < 20; i++ {
+				name := fmt.Sprintf("f%02d", i)
+				if err := writeFile(env.path(name), ""); err != nil {
+					return err
+				}
+				if i%2 == 0 {
+					want = append(want, name)
+				} else if err := os.Remove(env.path(name)); err != nil {
+					return err
+				}
+			}
+			got, err := listOwn(env)
+			if err != nil {
+				return err
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				return fmt.Errorf("%w: listed %v, want %v", ErrMismatch, got, want)
+			}
+			return nil
+		}},
+		{"many", func(env *Env) error {
+			/* more than one page of S3 listing */
+			const count = 1100
+			for i := 0; i < count; i++ {
+				if err := writeFile(env.path(fmt.Sprintf("f%04d", i)), ""); err != nil {
+					return err
+				}
+			}
+			got, err := listOwn(env)
+			if err != nil {
+				return err
+			}
+			if len(got) != count || len(slices.Compact(slices.Sorted(slices.Values(got)))) != count {
+				return fmt.Errorf("%w: listed %d entries, want %d", ErrMismatch, len(got), count)
+			}
+			return nil
+		}},
+	}},
+	{Name: "errors", Checks: []Check{
+		{"unlink_missing", func(env *Env) error {
+			return expectErrno(os.Remove(env.path("f")), syscall.ENOENT)
+		}},
+		{"mkdir_exists", func(env *Env) error {
+			if err := writeFile(env.path("f"), ""); err != nil {
+				return err
+			}
+			return expectErrno(os.Mkdir(env.path("f"), 0755), syscall.EEXIST)
+		}},
+		{"rmdir_notempty", func(env *Env) error {
+			if err := os.Mkdir(env.path("d"), 0755); err != nil {
+				return err
+			}
+			if err := writeFile(env.path("d")+"/f", ""); err != nil {
+				return err
+			}
+			return expectErrno(syscall.Rmdir(env.path("d")), syscall.ENOTEMPTY, syscall.EEXIST)
+		}},
+		{"unlink_dir", func(env *Env) error {
+			if err := os.Mkdir(env.path("d"), 0755); err != nil {
+				return err
+			}
+			/* linux returns EISDIR, POSIX allows EPERM */
+			return expectErrno(syscall.Unlink(env.path("d")), syscall.EISDIR, syscall.EPERM)
+		}},
+		{"open_dir_write", func(env *Env) error {
+			if err := os.Mkdir(env.path("d"), 0755); err != nil {
+				return err
+			}
+			_, err := os.OpenFile(env.path("d"), os.O_WRONLY, 0)
+			return expectErrno(err, syscall.EISDIR)
+		}},
+		{"notdir", func(env *Env) error {
+			if err := writeFile(env.path("f"), ""); err != nil {
+				return err
+			}
+			_, err := os.Stat(env.path("f") + "/x")
+			return expectErrno(err, syscall.ENOTDIR)
+		}},
+	}},
+	{Name: "permissions", Checks: []Check{
+		{"chmod", func(env *Env) error {
+			path := env.path("f")
+			if err := writeFile(path, ""); err != nil {
+				return err
+			}
+			if err := os.Chmod(path, 0640); err != nil {
+				return err
+			}
+			stat, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if stat.Mode().Perm() != 0640 {
+				return fmt.Errorf("%w: mode is %v, want 0640", ErrMismatch, stat.Mode().Perm())
+			}
+			return nil
+		}},
+		{"read_denied", func(env *Env) error {
+			if err := skipIfRoot(); err != nil {
+				return err
+			}
+			path := env.path("f")
+			if err := writeFile(path, "data"); err != nil {
+				return err
+			}
+			if err := os.Chmod(path, 0200); err != nil {
+				return err
+			}
+			_, err := os.ReadFile(path)
+			return expectErrno(err, syscall.EACCES)
+		}},
+		{"search_denied", func(env *Env) error {
+			if err := skipIfRoot(); err != nil {
+				return err
+			}
+			if err := os.Mkdir(env.path("d"), 0755); err != nil {
+				return err
+			}
+			if err := writeFile(env.path("d")+"/f", ""); err != nil {
+				return err
+			}
+			if err := os.Chmod(env.path("d"), 0600); err != nil {
+				return err
+			}
+			_, err := os.Stat(env.path("d") + "/f")
+			return expectErrno(err, syscall.EACCES)
+		}},
+	}},
+}
@@ -0,0 +1,223 @@
+package posixtest
+
+/* POSIX conformance checks in the spirit of pjdfstest */
+/* They work on any directory, usually a mount point of file system under test, */
+/* and report results per feature, so supported subset can be tracked */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrSkipped   = errors.New("check skipped")
+	ErrMismatch  = errors.New("unexpected result")
+	ErrWrongErrc = errors.New("unexpected error")
+)
+
+type Check struct {
+	Name string
+	/* run check, files must be created with env.path */
+	Run func(env *Env) error
+}
+
+type Feature struct {
+	Name   string
+	Checks []Check
+}
+
+/* scratch space of one check */
+type Env struct {
+	dir    string
+	prefix string
+}
+
+/* path of scratch file, unique for the check */
+func (env *Env) path(name string) string {
+	return filepath.Join(env.dir, env.prefix+name)
+}
+
+type Result struct {
+	Feature string
+	Check   string
+	Err     error
+}
+
+func (res Result) Skipped() bool {
+	return errors.Is(res.Err, ErrSkipped)
+}
+
+type Report []Result
+
+/* feature status: ok, fail or skip if all its checks were skipped */
+func (rep Report) Features() map[string]string {
+	status := make(map[string]string)
+	for _, res := range rep {
+		switch {
+		case res.Skipped():
+			if status[res.Feature] == "" {
+				status[res.Feature] = "skip"
+			}
+		case res.Err != nil:
+			status[res.Feature] = "fail"
+		case status[res.Feature] != "fail":
+			status[res.Feature] = "ok"
+		}
+	}
+	return status
+}
+
+/* one "feature status" line per feature, sorted */
+func (rep Report) Summary() string {
+	status := rep.Features()
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sum strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sum, "%s %s\n", name, status[name])
+	}
+	return sum.String()
+}
+
+/* run all checks of given features in dir, all features if none given */
+func Run(dir string, features ...string) Report {
+	var rep Report
+	for _, feature := range Features {
+		if len(features) != 0 && !contains(features, feature.Name) {
+			continue
+		}
+		for _, check := range feature.Checks {
+			env := &Env{dir: dir, prefix: feature.Name + "." + check.Name + "."}
+			err := check.Run(env)
+			env.cleanup()
+			rep = append(rep, Result{Feature: feature.Name, Check: check.Name, Err: err})
+		}
+	}
+	return rep
+}
+
+func contains(list []string, name string) bool {
+	for _, item := range list {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (env *Env) cleanup() {
+	matches, _ := filepath.Glob(filepath.Join(env.dir, env.prefix+"*"))
+	for _, match := range matches {
+		/* denied permissions may be left by check */
+		os.Chmod(match, 0700)
+		os.RemoveAll(match)
+	}
+}
+
+func skipIfRoot() error {
+	if os.Geteuid() == 0 {
+		return fmt.Errorf("%w: permissions aren't checked for root", ErrSkipped)
+	}
+	return nil
+}
+
+func expectErrno(err error, errnos ...syscall.Errno) error {
+	for _, errno := range errnos {
+		if errors.Is(err, errno) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: got %v, want %v", ErrWrongErrc, err, errnos)
+}
+
+func expectContent(path string, want []byte) error {
+	got, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%w: content of %s is %q, want %q", ErrMismatch, filepath.Base(path), shorten(got), shorten(want))
+	}
+	return nil
+}
+
+func shorten(data []byte) []byte {
+	if len(data) > 32 {
+		return data[:32]
+	}
+	return data
+}
+
+func expectSize(path string, want int64) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if stat.Size() != want {
+		return fmt.Errorf("%w: size of %s is %d, want %d", ErrMismatch, filepath.Base(path), stat.Size(), want)
+	}
+	return nil
+}
+
+func expectMissing(path string) error {
+	_, err := os.Lstat(path)
+	return expectErrno(err, syscall.ENOENT)
+}
+
+/* mtime must move forward from old one, set in the past */
+func expectMtimeUpdated(path string, update func() error) error {
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, past, past); err != nil {
+		return err
+	}
+	if err := update(); err != nil {
+		return err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !stat.ModTime().After(past.Add(30 * time.Minute)) {
+		return fmt.Errorf("%w: mtime %v wasn't updated", ErrMismatch, stat.ModTime())
+	}
+	return nil
+}
+
+/* list names in dir, that belong to check */
+func listOwn(env *Env) ([]string, error) {
+	entries, err := os.ReadDir(env.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if name, ok := strings.CutPrefix(entry.Name(), env.prefix); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func writeFile(path string, data string) error {
+	return os.WriteFile(path, []byte(data), 0644)
+}
+
+func readAt(file *os.File, size int, ofst int64) ([]byte, error) {
+	buff := make([]byte, size)
+	n, err := file.ReadAt(buff, ofst)
+	if err == io.EOF {
+		err = nil
+	}
+	return buff[:n], err
+}
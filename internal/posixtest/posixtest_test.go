@@ -0,0 +1,18 @@
+package posixtest
+
+import (
+	"testing"
+)
+
+/* checks must pass on local file system of the test machine */
+func TestLocalFs(t *testing.T) {
+	rep := Run(t.TempDir())
+	for _, res := range rep {
+		if res.Err != nil && !res.Skipped() {
+			t.Errorf("Check %s.%s failed, error: %v\n", res.Feature, res.Check, res.Err)
+		}
+	}
+	if len(rep.Features()) != len(Features) {
+		t.Errorf("Wrong summary:\n%s\n", rep.Summary())
+	}
+}
@@ -0,0 +1,526 @@
+package s3test
+
+/* In-process S3 compatible server for tests */
+/* It speaks enough of the S3 REST API (path style addressing only) for ss3fs: */
+/* head/get with ranges, put, copy, delete, list v2 and multipart uploads, */
+/* writes with If-Match and If-None-Match: * and x-amz-meta-* user metadata. */
+/* Requests aren't authenticated. */
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Server struct {
+	*httptest.Server
+	lock    sync.Mutex
+	buckets map[string]map[string]*object
+	uploads map[string]*upload
+	nextID  atomic.Uint64
+	/* answer conditional writes with NotImplemented, like older servers */
+	noConditions bool
+}
+
+type object struct {
+	data  []byte
+	etag  string
+	mtime time.Time
+	/* x-amz-meta-* headers as sent */
+	meta http.Header
+}
+
+type upload struct {
+	bucket string
+	key    string
+	parts  map[int][]byte
+	meta   http.Header
+}
+
+/* start server with given buckets, URL field is the endpoint */
+func NewServer(buckets ...string) *Server {
+	srv := &Server{
+		buckets: make(map[string]map[string]*object),
+		uploads: make(map[string]*upload),
+	}
+	for _, bucket := range buckets {
+		srv.buckets[bucket] = make(map[string]*object)
+	}
+	srv.Server = httptest.NewServer(srv)
+	return srv
+}
+
+/* PutObject stores object directly, bypassing HTTP */
+func (srv *Server) PutObject(bucket string, key string, data []byte) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.buckets[bucket][key] = newObject(data)
+}
+
+/* Object returns content of object and true if it exists */
+func (srv *Server) Object(bucket string, key string) ([]byte, bool) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	obj, ok := srv.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), obj.data...), true
+}
+
+/* Keys returns sorted keys of the bucket */
+func (srv *Server) Keys(bucket string) []string {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	keys := make([]string, 0, len(srv.buckets[bucket]))
+	for key := range srv.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newObject(data []byte) *object {
+	sum := md5.Sum(data)
+	return &object{
+		data:  data,
+		etag:  "\"" + hex.EncodeToString(sum[:]) + "\"",
+		mtime: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestId string
+}
+
+func (srv *Server) fail(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	xml.NewEncoder(w).Encode(s3Error{
+		Code:      code,
+		Message:   code,
+		Resource:  r.URL.Path,
+		RequestId: w.Header().Get("x-amz-request-id"),
+	})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("x-amz-request-id", fmt.Sprintf("s3test-%d", srv.nextID.Add(1)))
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	objects, ok := srv.buckets[bucket]
+	if !ok {
+		srv.fail(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	if key == "" {
+		switch r.Method {
+		case http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			srv.list(w, r, objects)
+		default:
+			srv.fail(w, r, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		srv.createUpload(w, r, bucket, key)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		srv.completeUpload(w, r, objects, bucket, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		srv.uploadPart(w, r, bucket, key)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		if _, ok := srv.uploads[query.Get("uploadId")]; !ok {
+			srv.fail(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(srv.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("x-amz-copy-source") != "":
+		srv.copyObject(w, r, objects, key)
+	case r.Method == http.MethodPut:
+		if !srv.checkConditions(w, r, objects, key) {
+			return
+		}
+		data, err := readBody(r)
+		if err != nil {
+			srv.fail(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		obj := newObject(data)
+		obj.meta = userMeta(r)
+		objects[key] = obj
+		w.Header().Set("ETag", obj.etag)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		obj, ok := objects[key]
+		if !ok {
+			srv.fail(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		srv.get(w, r, obj)
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		srv.fail(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+/* DisableConditions makes server reject conditional writes */
+func (srv *Server) DisableConditions() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.noConditions = true
+}
+
+/* If-Match and If-None-Match: * of writes, false if request failed */
+func (srv *Server) checkConditions(w http.ResponseWriter, r *http.Request, objects map[string]*object, key string) bool {
+	obj, exists := objects[key]
+	match := r.Header.Get("If-Match")
+	switch {
+	case srv.noConditions && (match != "" || r.Header.Get("If-None-Match") != ""):
+		srv.fail(w, r, http.StatusNotImplemented, "NotImplemented")
+		return false
+	case match != "" && !exists:
+		srv.fail(w, r, http.StatusNotFound, "NoSuchKey")
+		return false
+	case match != "" && match != "*" && match != obj.etag:
+		srv.fail(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+		return false
+	case r.Header.Get("If-None-Match") == "*" && exists:
+		srv.fail(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+		return false
+	}
+	return true
+}
+
+/* user metadata headers of request */
+func userMeta(r *http.Request) http.Header {
+	meta := http.Header{}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			meta[name] = values
+		}
+	}
+	return meta
+}
+
+/* SDK may send payload in aws-chunked encoding */
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("x-amz-content-sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	rd := bufio.NewReader(r.Body)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func (srv *Server) get(w http.ResponseWriter, r *http.Request, obj *object) {
+	size := int64(len(obj.data))
+	start, end := int64(0), size-1
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var ok bool
+		start, end, ok = parseRange(rng, size)
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			srv.fail(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		status = http.StatusPartialContent
+	}
+	for name, values := range obj.meta {
+		w.Header()[name] = values
+	}
+	w.Header().Set("ETag", obj.etag)
+	w.Header().Set("Last-Modified", obj.mtime.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(obj.data[start : end+1])
+	}
+}
+
+/* only "bytes=a-b", "bytes=a-" and "bytes=-n" forms */
+func parseRange(rng string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(rng, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+type copyResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string
+	LastModified string
+}
+
+func (srv *Server) copyObject(w http.ResponseWriter, r *http.Request, objects map[string]*object, key string) {
+	source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("x-amz-copy-source"), "/"))
+	if err != nil {
+		srv.fail(w, r, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	srcBucket, srcKey, _ := strings.Cut(source, "/")
+	src, ok := srv.buckets[srcBucket][srcKey]
+	if !ok {
+		srv.fail(w, r, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	/* metadata is copied, x-amz-metadata-directive REPLACE isn't supported */
+	obj := newObject(src.data)
+	obj.meta = src.meta
+	objects[key] = obj
+	writeXML(w, copyResult{ETag: obj.etag, LastModified: obj.mtime.Format(time.RFC3339)})
+}
+
+type listContent struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type listPrefix struct {
+	Prefix string
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []listContent
+	CommonPrefixes        []listPrefix
+}
+
+func (srv *Server) list(w http.ResponseWriter, r *http.Request, objects map[string]*object) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	token := query.Get("continuation-token")
+	maxKeys := 1000
+	if v := query.Get("max-keys"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n < maxKeys {
+			maxKeys = n
+		}
+	}
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	res := listResult{
+		Name:              strings.Trim(r.URL.Path, "/"),
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		ContinuationToken: token,
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		entry := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		/* continuation token is the last returned entry */
+		if entry <= token || seen[entry] {
+			continue
+		}
+		if res.KeyCount == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+		seen[entry] = true
+		res.KeyCount++
+		res.NextContinuationToken = entry
+		if entry != key {
+			res.CommonPrefixes = append(res.CommonPrefixes, listPrefix{Prefix: entry})
+			continue
+		}
+		obj := objects[key]
+		res.Contents = append(res.Contents, listContent{
+			Key:          key,
+			LastModified: obj.mtime.Format(time.RFC3339),
+			ETag:         obj.etag,
+			Size:         int64(len(obj.data)),
+			StorageClass: "STANDARD",
+		})
+	}
+	if !res.IsTruncated {
+		res.NextContinuationToken = ""
+	}
+	writeXML(w, res)
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+func (srv *Server) createUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	id := fmt.Sprintf("upload-%d", srv.nextID.Add(1))
+	srv.uploads[id] = &upload{bucket: bucket, key: key, parts: make(map[int][]byte), meta: userMeta(r)}
+	writeXML(w, initiateResult{Bucket: bucket, Key: key, UploadId: id})
+}
+
+func (srv *Server) uploadPart(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	query := r.URL.Query()
+	up, ok := srv.uploads[query.Get("uploadId")]
+	if !ok || up.bucket != bucket || up.key != key {
+		srv.fail(w, r, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || number < 1 || number > 10000 {
+		srv.fail(w, r, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	data, err := readBody(r)
+	if err != nil {
+		srv.fail(w, r, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	up.parts[number] = data
+	w.Header().Set("ETag", newObject(data).etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+func (srv *Server) completeUpload(w http.ResponseWriter, r *http.Request, objects map[string]*object, bucket string, key string) {
+	id := r.URL.Query().Get("uploadId")
+	up, ok := srv.uploads[id]
+	if !ok || up.bucket != bucket || up.key != key {
+		srv.fail(w, r, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	var req completeRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Parts) == 0 {
+		srv.fail(w, r, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	var data []byte
+	for i, part := range req.Parts {
+		partData, ok := up.parts[part.PartNumber]
+		if !ok || newObject(partData).etag != part.ETag {
+			srv.fail(w, r, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			srv.fail(w, r, http.StatusBadRequest, "InvalidPartOrder")
+			return
+		}
+		data = append(data, partData...)
+	}
+	/* failed condition leaves upload, it may be completed again */
+	if !srv.checkConditions(w, r, objects, key) {
+		return
+	}
+	delete(srv.uploads, id)
+	obj := newObject(data)
+	obj.meta = up.meta
+	objects[key] = obj
+	writeXML(w, completeResult{Bucket: bucket, Key: key, ETag: obj.etag})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestNewLoggerJSON(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := newLogger(&out, "warn", "json")
+	if err != nil {
+		t.Errorf("Can't create logger, error: %v\n", err)
+		return
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "path", "/file")
+	var record map[string]any
+	err = json.Unmarshal(out.Bytes(), &record)
+	if err != nil {
+		t.Errorf("Output %q isn't single json record, error: %v\n", out.String(), err)
+		return
+	}
+	if record["msg"] != "shown" || record["path"] != "/file" {
+		t.Errorf("Wrong record %v\n", record)
+	}
+}
+
+func TestNewLoggerBad(t *testing.T) {
+	_, err := newLogger(&bytes.Buffer{}, "info", "xml")
+	if !errors.Is(err, ErrBadLogFormat) {
+		t.Errorf("Bad format was accepted, error: %v\n", err)
+	}
+	_, err = newLogger(&bytes.Buffer{}, "verbose", "text")
+	if err == nil {
+		t.Errorf("Bad level was accepted\n")
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"ss3fs/ss3fs"
+	"time"
 
 	"github.com/winfsp/cgofuse/fuse"
 )
@@ -16,6 +18,18 @@ type Params struct {
 	EndPoint   *string
 	MountPoint *string
 	Region     *string
+	Options    mountOptions
+	/* time given to pending uploads on SIGINT or SIGTERM */
+	ShutdownTimeout *time.Duration
+	LogLevel        *string
+	LogFormat       *string
+	S3Debug         *bool
+	/* host:port for prometheus /metrics, disabled if empty */
+	MetricsAddr *string
+	/* host:port for S3 event notifications, disabled if empty */
+	NotifyAddr *string
+	/* json rules of injected S3 faults, for debugging only */
+	FaultConfig *string
 }
 
 var Flags *flag.FlagSet = flag.NewFlagSet("", flag.ExitOnError)
@@ -29,20 +43,106 @@ func parseParams() *Params {
 		MountPoint: Flags.String("m", "", "Mount point"),
 		Region:     Flags.String("r", "us-west-2", "AWS region"),
 	}
+	params.ShutdownTimeout = Flags.Duration("shutdown-timeout", defaultShutdownTimeout, "Time to wait for pending uploads on unmount, SIGINT or SIGTERM")
+	params.LogLevel = Flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	params.LogFormat = Flags.String("log-format", "text", "Log format: text or json")
+	params.S3Debug = Flags.Bool("s3-debug", false, "Log every S3 request with its request id, needs debug log level")
+	params.MetricsAddr = Flags.String("metrics-addr", "", "Listen address for prometheus metrics, e.g. :9100")
+	params.NotifyAddr = Flags.String("notify-addr", "", "Listen address for S3 bucket notifications (webhook), e.g. 127.0.0.1:9200")
+	params.FaultConfig = Flags.String("fault-config", "", "Inject S3 faults described in json file, for debugging only")
+	Flags.Var(&params.Options, "o", "Mount options, comma separated (uid, gid, umask or any FUSE option)")
 	Flags.Parse(os.Args[1:])
 	return &params
 }
 
+const defaultShutdownTimeout = 30 * time.Second
+
+/* reports, when file system is mounted and ready to serve requests */
+type mountNotifier struct {
+	fuse.FileSystemInterface
+	mounted func()
+}
+
+func (n *mountNotifier) Init() {
+	n.FileSystemInterface.Init()
+	n.mounted()
+}
+
+/* mount file system and serve it until unmount, returns exit code */
+/* ready, if given, is called once the mount point is usable */
+func mount(param *Params, ready func()) int {
+	logger, err := newLogger(os.Stderr, *param.LogLevel, *param.LogFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't configure logging, error %v\n", err)
+		return exitUsage
+	}
+	slog.SetDefault(logger)
+	fsOpts, fuseOpts, err := splitMountOptions(param.Options, *param.Bucket)
+	if err != nil {
+		slog.Error("can't parse mount options", "err", err)
+		return exitUsage
+	}
+	fsOpts.Logger = logger
+	fsOpts.S3Debug = *param.S3Debug
+	if *param.MetricsAddr != "" {
+		fsOpts.Metrics, err = serveMetrics(*param.MetricsAddr)
+		if err != nil {
+			slog.Error("can't serve metrics", "addr", *param.MetricsAddr, "err", err)
+			return exitSystem
+		}
+	}
+	fsOpts.UnmountTimeout = *param.ShutdownTimeout
+	fsOpts.Notifications = *param.NotifyAddr != ""
+	if *param.FaultConfig != "" {
+		fsOpts.Faults, err = ss3fs.LoadFaultConfig(*param.FaultConfig)
+		if err != nil {
+			slog.Error("can't load fault config", "path", *param.FaultConfig, "err", err)
+			return exitUsage
+		}
+	}
+	fs, err := ss3fs.NewSs3fs(param.Access, param.Secret, param.Region, param.Bucket, param.EndPoint, fsOpts)
+	if err != nil {
+		slog.Error("can't initialize ss3fs", "bucket", *param.Bucket, "err", err)
+		return exitMountFailure
+	}
+	if *param.NotifyAddr != "" {
+		if err := serveNotifications(*param.NotifyAddr, fs.NotificationHandler(*param.Bucket)); err != nil {
+			slog.Error("can't serve notifications", "addr", *param.NotifyAddr, "err", err)
+			fs.Destroy()
+			return exitSystem
+		}
+	}
+
+	var host *fuse.FileSystemHost
+	shutdown := newShutdownHandler(fs, *param.ShutdownTimeout)
+	defer shutdown.stop()
+	host = fuse.NewFileSystemHost(&mountNotifier{
+		FileSystemInterface: fs,
+		mounted: func() {
+			shutdown.start(host)
+			if ready != nil {
+				ready()
+			}
+		},
+	})
+	if !host.Mount(*param.MountPoint, fuseOpts) {
+		slog.Error("mount failed", "mountpoint", *param.MountPoint)
+		/* workers, poller and lease renewal started already */
+		fs.Destroy()
+		return exitMountFailure
+	}
+	if shutdown.lost.Load() || fs.ChangesLost() {
+		return exitDataLost
+	}
+	return exitOk
+}
+
 /* simple implementation for s3fs */
 /* */
 func main() {
-	param := parseParams()
-	fs, err := ss3fs.NewSs3fs(param.Access, param.Secret, param.Region, param.Bucket, param.EndPoint)
-	if err != nil {
-		fmt.Printf("Can't initialize ss3fs, error %v\n", err)
-		return
+	if isMountHelper(os.Args) {
+		os.Exit(mountHelper(os.Args))
 	}
-
-	host := fuse.NewFileSystemHost(fs)
-	host.Mount(*param.MountPoint, nil)
+	param := parseParams()
+	os.Exit(mount(param, nil))
 }
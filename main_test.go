@@ -2,24 +2,174 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"ss3fs/internal/posixtest"
+	"ss3fs/internal/s3test"
+	"ss3fs/ramfs"
+	"ss3fs/ss3fs"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
 )
 
 const (
-	mp   = "./test/"
 	tf   = "test_file.txt"
 	data = "somedata\n"
+	/* how long to wait for mount to become ready */
+	mountTimeout = 10 * time.Second
 )
 
 var (
 	ErrFileNotFound = errors.New("file not found in listing")
+	ErrMountTimeout = errors.New("mount point wasn't ready in time")
+	ErrMountFailed  = errors.New("mount failed")
 )
 
+/* mounted file system under test */
+type backend struct {
+	name string
+	/* mount point with trailing slash */
+	mp   string
+	host *fuse.FileSystemHost
+	done chan struct{}
+}
+
+var (
+	backends []*backend
+	/* reason, why tests are skipped, if nothing was mounted */
+	skipReason string
+)
+
+/* mount fs on fresh temp directory and wait for Init */
+func mountBackend(name string, fs fuse.FileSystemInterface) (*backend, error) {
+	dir, err := os.MkdirTemp("", "ss3fs-"+name+"-")
+	if err != nil {
+		return nil, err
+	}
+	ready := make(chan struct{})
+	b := &backend{name: name, mp: dir + "/", done: make(chan struct{})}
+	b.host = fuse.NewFileSystemHost(&mountNotifier{
+		FileSystemInterface: fs,
+		mounted:             func() { close(ready) },
+	})
+	failed := make(chan error, 1)
+	go func() {
+		defer close(b.done)
+		/* cgofuse panics if libfuse can't be loaded */
+		defer func() {
+			if r := recover(); r != nil {
+				failed <- fmt.Errorf("%w: %v", ErrMountFailed, r)
+			}
+		}()
+		if !b.host.Mount(dir, []string{"-o", "fsname=" + name}) {
+			failed <- fmt.Errorf("%w: %s on %s", ErrMountFailed, name, dir)
+		}
+	}()
+	select {
+	case <-ready:
+		return b, nil
+	case err = <-failed:
+	case <-time.After(mountTimeout):
+		b.host.Unmount()
+		err = fmt.Errorf("%w: %s on %s", ErrMountTimeout, name, dir)
+	}
+	os.Remove(dir)
+	return nil, err
+}
+
+func (b *backend) unmount() {
+	if b.host.Unmount() {
+		<-b.done
+	}
+	os.Remove(strings.TrimSuffix(b.mp, "/"))
+}
+
+func newBackends() (func(), error) {
+	srv := s3test.NewServer("bucket")
+	acc, sec, region, bucket := "test", "test", "us-east-1", "bucket"
+	s3fs, err := ss3fs.NewSs3fs(&acc, &sec, &region, &bucket, &srv.URL, ss3fs.DefaultOptions())
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	ram := &ramfs.RamFs{}
+	ram.FsInit()
+	cleanup := func() {
+		for _, b := range backends {
+			b.unmount()
+		}
+		srv.Close()
+	}
+	for _, fs := range []struct {
+		name string
+		fs   fuse.FileSystemInterface
+	}{{"ss3fs", s3fs}, {"ramfs", ram}} {
+		b, err := mountBackend(fs.name, fs.fs)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		backends = append(backends, b)
+	}
+	return cleanup, nil
+}
+
+func runTests(m *testing.M) int {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		skipReason = fmt.Sprintf("no fuse device: %v", err)
+		return m.Run()
+	}
+	cleanup, err := newBackends()
+	if err != nil {
+		backends = nil
+		skipReason = err.Error()
+		return m.Run()
+	}
+	/* unmount even if some test panics */
+	defer cleanup()
+	return m.Run()
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+/* run test on every mounted backend */
+func forEachBackend(t *testing.T, test func(t *testing.T, mp string)) {
+	if len(backends) == 0 {
+		t.Skipf("Nothing mounted: %s\n", skipReason)
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			test(t, b.mp)
+		})
+	}
+}
+
 /* tests of ss3fs */
 func TestCreateFileRemove(t *testing.T) {
+	forEachBackend(t, testCreateFileRemove)
+}
+
+func TestCreateFileWR(t *testing.T) {
+	forEachBackend(t, testCreateFileWR)
+}
+
+func TestCreateFileOpen(t *testing.T) {
+	forEachBackend(t, testCreateFileOpen)
+}
+
+func TestReadDir(t *testing.T) {
+	forEachBackend(t, testReadDir)
+}
+
+func testCreateFileRemove(t *testing.T, mp string) {
 	_, err := os.Create(mp + tf)
 	if err != nil {
 		t.Errorf("File wasn't created, error: %v\n", err)
@@ -33,7 +183,7 @@ func TestCreateFileRemove(t *testing.T) {
 	}
 }
 
-func TestCreateFileWR(t *testing.T) {
+func testCreateFileWR(t *testing.T, mp string) {
 	file, err := os.Create(mp + tf)
 	if err != nil {
 		t.Errorf("File wasn't created, error: %v\n", err)
@@ -56,7 +206,7 @@ func TestCreateFileWR(t *testing.T) {
 	}
 }
 
-func TestCreateFileOpen(t *testing.T) {
+func testCreateFileOpen(t *testing.T, mp string) {
 	file, err := os.Create(mp + tf)
 	if err != nil {
 		t.Errorf("File wasn't created, error: %v\n", err)
@@ -84,7 +234,7 @@ func TestCreateFileOpen(t *testing.T) {
 	}
 }
 
-func TestReadDir(t *testing.T) {
+func testReadDir(t *testing.T, mp string) {
 	file, err := os.Create(mp + tf)
 	if err != nil {
 		t.Errorf("File wasn't created, error: %v\n", err)
@@ -117,3 +267,81 @@ func TestReadDir(t *testing.T) {
 		return
 	}
 }
+
+var (
+	posixDir    = flag.String("posix.dir", "", "run POSIX conformance suite on this mounted directory")
+	posixUpdate = flag.Bool("posix.update", false, "rewrite expected POSIX conformance results")
+)
+
+/* expected features of backend, one "feature status" line each */
+func posixBaseline(name string) string {
+	return filepath.Join("testdata", "posix", name+".txt")
+}
+
+/* report features per subtest, fail only if feature supported before is broken */
+func checkPOSIX(t *testing.T, dir string, expected map[string]string) posixtest.Report {
+	rep := posixtest.Run(dir)
+	status := rep.Features()
+	for _, feature := range posixtest.Features {
+		t.Run(feature.Name, func(t *testing.T) {
+			for _, res := range rep {
+				if res.Feature == feature.Name && res.Err != nil {
+					t.Logf("%s: %v\n", res.Check, res.Err)
+				}
+			}
+			switch {
+			case status[feature.Name] == "skip":
+				t.Skip("All checks skipped\n")
+			case status[feature.Name] == "ok":
+			case expected == nil || expected[feature.Name] == "ok":
+				t.Errorf("Feature %s isn't supported\n", feature.Name)
+			}
+		})
+	}
+	return rep
+}
+
+func readBaseline(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	expected := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if feature, status, ok := strings.Cut(line, " "); ok {
+			expected[feature] = status
+		}
+	}
+	return expected, nil
+}
+
+func TestPOSIX(t *testing.T) {
+	if *posixDir != "" {
+		checkPOSIX(t, *posixDir, nil)
+		return
+	}
+	forEachBackend(t, func(t *testing.T, mp string) {
+		name := filepath.Base(t.Name())
+		expected, err := readBaseline(posixBaseline(name))
+		if err != nil {
+			if !*posixUpdate {
+				t.Errorf("No expected results, run with -posix.update to record them: %v\n", err)
+				return
+			}
+			expected = map[string]string{}
+		}
+		rep := checkPOSIX(t, mp, expected)
+		if *posixUpdate {
+			os.MkdirAll(filepath.Dir(posixBaseline(name)), 0755)
+			if err := os.WriteFile(posixBaseline(name), []byte(rep.Summary()), 0644); err != nil {
+				t.Errorf("Can't write expected results, error: %v\n", err)
+			}
+		}
+		for _, line := range strings.Split(strings.TrimSpace(rep.Summary()), "\n") {
+			feature, status, _ := strings.Cut(line, " ")
+			if status == "ok" && expected[feature] != "ok" && !*posixUpdate {
+				t.Logf("Feature %s is supported now, update expected results\n", feature)
+			}
+		}
+	})
+}
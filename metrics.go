@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+
+	"ss3fs/ss3fs"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/* start listener with /metrics on addr, it is served until process exits */
+func serveMetrics(addr string) (*ss3fs.Metrics, error) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	metrics := ss3fs.NewMetrics(reg)
+
+	/* listen here, so wrong address fails the mount instead of being logged later */
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	go func() {
+		err := http.Serve(ln, mux)
+		slog.Error("metrics listener stopped", "addr", addr, "err", err)
+	}()
+	slog.Info("serving metrics", "addr", ln.Addr().String())
+	return metrics, nil
+}
+
+/* start listener for S3 event notifications on addr, any path is accepted */
+func serveNotifications(addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := http.Serve(ln, handler)
+		slog.Error("notification listener stopped", "addr", addr, "err", err)
+	}()
+	slog.Info("serving bucket notifications", "addr", ln.Addr().String())
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* exit codes, that mount(8) expects from helpers */
+const (
+	exitOk           = 0
+	exitUsage        = 1
+	exitSystem       = 2
+	exitMountFailure = 32
+)
+
+var (
+	ErrBadHelperArgs  = errors.New("usage: mount.ss3fs bucket mountpoint [-sfnv] [-o options]")
+	ErrBadPasswdFile  = errors.New("bad passwd file")
+	ErrNoCredsInFile  = errors.New("no credentials for bucket in passwd file")
+	ErrOpenPasswdFile = errors.New("passwd file is accessible by others")
+)
+
+/* helper is used if binary called as mount.ss3fs (mount -t ss3fs) or */
+/* in mount.fuse style "ss3fs bucket mountpoint -o ..." (mount -t fuse.ss3fs) */
+func isMountHelper(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	name := filepath.Base(args[0])
+	if strings.HasPrefix(name, "mount.") {
+		return true
+	}
+	return len(args) > 1 && !strings.HasPrefix(args[1], "-")
+}
+
+type helperArgs struct {
+	params Params
+	fake   bool
+}
+
+/* parse mount(8) style arguments: source mountpoint [-sfnv] [-o options] [-t type] */
+func parseHelperArgs(args []string) (*helperArgs, error) {
+	h := &helperArgs{}
+	empty := ""
+	region := "us-west-2"
+	timeout := defaultShutdownTimeout
+	logLevel, logFormat, s3Debug, metricsAddr, notifyAddr, faultConfig := "info", "text", false, "", "", ""
+	h.params = Params{
+		Access:          &empty,
+		Secret:          &empty,
+		Region:          &region,
+		EndPoint:        &empty,
+		ShutdownTimeout: &timeout,
+		LogLevel:        &logLevel,
+		LogFormat:       &logFormat,
+		S3Debug:         &s3Debug,
+		MetricsAddr:     &metricsAddr,
+		NotifyAddr:      &notifyAddr,
+		FaultConfig:     &faultConfig,
+	}
+	var opts mountOptions
+	positional := make([]string, 0, 2)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o" || arg == "-t":
+			if i+1 >= len(args) {
+				return nil, ErrBadHelperArgs
+			}
+			i++
+			if arg == "-o" {
+				opts.Set(args[i])
+			}
+		case strings.HasPrefix(arg, "-o"):
+			opts.Set(arg[2:])
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			for _, flag := range arg[1:] {
+				switch flag {
+				case 'f':
+					h.fake = true
+				case 's', 'n', 'v':
+					/* sloppy, no mtab and verbose mean nothing for us */
+				default:
+					return nil, ErrBadHelperArgs
+				}
+			}
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, ErrBadHelperArgs
+	}
+	/* old fstab style "ss3fs#bucket" */
+	bucket := strings.TrimPrefix(positional[0], "ss3fs#")
+	mountPoint := positional[1]
+	h.params.Bucket = &bucket
+	h.params.MountPoint = &mountPoint
+
+	passwdFile := ""
+	for _, opt := range opts {
+		key, value, _ := strings.Cut(opt, "=")
+		switch {
+		case key == "endpoint":
+			h.params.EndPoint = &value
+		case key == "region":
+			h.params.Region = &value
+		case key == "passwd_file":
+			passwdFile = value
+		case key == "log_level":
+			logLevel = value
+		case key == "log_format":
+			logFormat = value
+		case key == "s3_debug":
+			s3Debug = true
+		case key == "metrics_addr":
+			metricsAddr = value
+		case key == "notify_addr":
+			notifyAddr = value
+		case key == "fault_config":
+			faultConfig = value
+		case key == "_netdev" || key == "nofail" || key == "auto" || key == "noauto" || key == "user" || key == "nouser" ||
+			key == "users" || key == "defaults" || key == "comment" || strings.HasPrefix(key, "x-"):
+			/* ordering and failure handling is done by mount(8) and systemd, FUSE would reject them */
+		default:
+			h.params.Options = append(h.params.Options, opt)
+		}
+	}
+	if passwdFile != "" {
+		access, secret, err := readPasswdFile(passwdFile, bucket)
+		if err != nil {
+			return nil, err
+		}
+		h.params.Access = &access
+		h.params.Secret = &secret
+	}
+	return h, nil
+}
+
+/* passwd file contains "access:secret" or "bucket:access:secret" lines */
+func readPasswdFile(path string, bucket string) (string, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	if info.Mode().Perm()&0007 != 0 {
+		return "", "", fmt.Errorf("%w: %s", ErrOpenPasswdFile, path)
+	}
+	access, secret := "", ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		switch len(fields) {
+		case 2:
+			/* default credentials, bucket specific line wins */
+			if access == "" {
+				access, secret = fields[0], fields[1]
+			}
+		case 3:
+			if fields[0] == bucket {
+				access, secret = fields[1], fields[2]
+			}
+		default:
+			return "", "", fmt.Errorf("%w: %s", ErrBadPasswdFile, path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if access == "" {
+		return "", "", fmt.Errorf("%w: %s", ErrNoCredsInFile, path)
+	}
+	return access, secret, nil
+}
+
+/* entry point for mount(8), returns exit code */
+func mountHelper(args []string) int {
+	h, err := parseHelperArgs(args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mount.ss3fs: %v\n", err)
+		return exitUsage
+	}
+	if h.fake {
+		return exitOk
+	}
+	ready := daemonReady()
+	if ready == nil {
+		/* we are the process started by mount(8), wait until daemon mounts the bucket */
+		return daemonize()
+	}
+	return mount(&h.params, ready)
+}
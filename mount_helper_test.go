@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIsMountHelper(t *testing.T) {
+	cases := map[bool][][]string{
+		true:  {{"/sbin/mount.ss3fs", "bucket", "/mnt"}, {"ss3fs", "bucket", "/mnt", "-o", "ro"}},
+		false: {{"ss3fs", "-b", "bucket", "-m", "/mnt"}, {"ss3fs"}},
+	}
+	for expected, argsList := range cases {
+		for _, args := range argsList {
+			if isMountHelper(args) != expected {
+				t.Errorf("Helper mode for %v should be %v\n", args, expected)
+			}
+		}
+	}
+}
+
+func TestParseHelperArgs(t *testing.T) {
+	passwd := filepath.Join(t.TempDir(), "passwd")
+	err := os.WriteFile(passwd, []byte("# comment\ndefault:key\nbucket:acc:sec\n"), 0600)
+	if err != nil {
+		t.Errorf("Can't write passwd file, error: %v\n", err)
+		return
+	}
+	args := []string{"ss3fs#bucket", "/mnt/data", "-n", "-o",
+		"rw,_netdev,nofail,x-systemd.automount,endpoint=http://localhost:9000,passwd_file=" + passwd + ",uid=10,allow_other,notify_addr=:9200"}
+	h, err := parseHelperArgs(args)
+	if err != nil {
+		t.Errorf("Can't parse helper args, error: %v\n", err)
+		return
+	}
+	if *h.params.Bucket != "bucket" || *h.params.MountPoint != "/mnt/data" {
+		t.Errorf("Wrong source %s or mount point %s\n", *h.params.Bucket, *h.params.MountPoint)
+	}
+	if *h.params.EndPoint != "http://localhost:9000" || *h.params.Access != "acc" || *h.params.Secret != "sec" {
+		t.Errorf("Wrong connection settings %s %s %s\n", *h.params.EndPoint, *h.params.Access, *h.params.Secret)
+	}
+	if *h.params.NotifyAddr != ":9200" {
+		t.Errorf("Wrong notification address %s\n", *h.params.NotifyAddr)
+	}
+	expected := mountOptions{"rw", "uid=10", "allow_other"}
+	if !reflect.DeepEqual(h.params.Options, expected) {
+		t.Errorf("Wrong options %v, expected %v\n", h.params.Options, expected)
+	}
+	if h.fake {
+		t.Errorf("Fake mount wasn't requested\n")
+	}
+}
+
+func TestParseHelperArgsBad(t *testing.T) {
+	_, err := parseHelperArgs([]string{"bucket"})
+	if !errors.Is(err, ErrBadHelperArgs) {
+		t.Errorf("Missing mount point was accepted, error: %v\n", err)
+	}
+	passwd := filepath.Join(t.TempDir(), "passwd")
+	os.WriteFile(passwd, []byte("acc:sec\n"), 0644)
+	_, err = parseHelperArgs([]string{"bucket", "/mnt", "-o", "passwd_file=" + passwd})
+	if !errors.Is(err, ErrOpenPasswdFile) {
+		t.Errorf("World readable passwd file was accepted, error: %v\n", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"ss3fs/ss3fs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadMountOption = errors.New("bad mount option")
+)
+
+/* value of the -o flag, may be repeated, every occurrence is comma separated list */
+type mountOptions []string
+
+func (m *mountOptions) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *mountOptions) Set(value string) error {
+	for _, opt := range strings.Split(value, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt != "" {
+			*m = append(*m, opt)
+		}
+	}
+	return nil
+}
+
+/* split -o options into ones ss3fs understands itself and ones, that are passed to fuse */
+/* fuse options are returned in the form expected by host.Mount */
+func splitMountOptions(opts []string, bucket string) (ss3fs.Options, []string, error) {
+	fsOpts := ss3fs.DefaultOptions()
+	fuseOpts := make([]string, 0, len(opts)+2)
+	hasFsName, hasSubtype := false, false
+	for _, opt := range opts {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "uid":
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fsOpts, nil, fmt.Errorf("%w %q: %v", ErrBadMountOption, opt, err)
+			}
+			fsOpts.Uid = uint32(id)
+		case "gid":
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fsOpts, nil, fmt.Errorf("%w %q: %v", ErrBadMountOption, opt, err)
+			}
+			fsOpts.Gid = uint32(id)
+		case "umask":
+			umask, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || umask > 0777 {
+				return fsOpts, nil, fmt.Errorf("%w %q: umask must be octal number up to 0777", ErrBadMountOption, opt)
+			}
+			fsOpts.SetUmask(uint32(umask))
+		case "meta_timeout", "data_timeout", "retry_backoff", "retry_max_backoff", "offline_probe",
+			"poll_interval", "meta_ttl", "lock_lease":
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration < 0 {
+				return fsOpts, nil, fmt.Errorf("%w %q: duration like 30s expected", ErrBadMountOption, opt)
+			}
+			switch key {
+			case "meta_timeout":
+				fsOpts.MetaTimeout = duration
+			case "data_timeout":
+				fsOpts.DataTimeout = duration
+			case "retry_backoff":
+				fsOpts.Retry.MinBackoff = duration
+			case "retry_max_backoff":
+				fsOpts.Retry.MaxBackoff = duration
+			case "offline_probe":
+				if duration == 0 {
+					return fsOpts, nil, fmt.Errorf("%w %q: probe interval must be positive", ErrBadMountOption, opt)
+				}
+				fsOpts.OfflineProbe = duration
+			case "poll_interval":
+				fsOpts.PollInterval = duration
+			case "meta_ttl":
+				fsOpts.MetaTTL = duration
+			case "lock_lease":
+				fsOpts.LockLease = duration
+			}
+		case "retries":
+			attempts, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || attempts == 0 {
+				return fsOpts, nil, fmt.Errorf("%w %q: number of attempts expected", ErrBadMountOption, opt)
+			}
+			fsOpts.Retry.MaxAttempts = int(attempts)
+		case "retry_jitter":
+			jitter, err := strconv.ParseFloat(value, 64)
+			if err != nil || jitter < 0 || jitter > 1 {
+				return fsOpts, nil, fmt.Errorf("%w %q: jitter must be from 0 to 1", ErrBadMountOption, opt)
+			}
+			fsOpts.Retry.Jitter = jitter
+		case "retry_codes":
+			/* colon separated, comma already separates options */
+			fsOpts.Retry.RetryableCodes = strings.Split(value, ":")
+		case "consistency":
+			if value != ss3fs.ConsistencyTTL && value != ss3fs.ConsistencyCloseToOpen {
+				return fsOpts, nil, fmt.Errorf("%w %q: %s or %s expected", ErrBadMountOption, opt,
+					ss3fs.ConsistencyTTL, ss3fs.ConsistencyCloseToOpen)
+			}
+			fsOpts.Consistency = value
+		case "conflict":
+			if value != ss3fs.ConflictFail && value != ss3fs.ConflictOverwrite && value != ss3fs.ConflictSibling {
+				return fsOpts, nil, fmt.Errorf("%w %q: %s, %s or %s expected", ErrBadMountOption, opt,
+					ss3fs.ConflictFail, ss3fs.ConflictOverwrite, ss3fs.ConflictSibling)
+			}
+			fsOpts.Conflict = value
+		case "poll_prefixes":
+			fsOpts.PollPrefixes = strings.Split(value, ":")
+		case "upload_workers":
+			workers, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return fsOpts, nil, fmt.Errorf("%w %q: number of workers expected", ErrBadMountOption, opt)
+			}
+			fsOpts.UploadWorkers = int(workers)
+		case "upload_budget":
+			size, err := parseSize(value)
+			if err != nil || size <= 0 {
+				return fsOpts, nil, fmt.Errorf("%w %q: size like 512M or 10G expected", ErrBadMountOption, opt)
+			}
+			fsOpts.UploadBudget = size
+		case "offline":
+			fsOpts.Offline = true
+		case "cache_dir":
+			fsOpts.CacheDir = value
+		case "cache_size":
+			size, err := parseSize(value)
+			if err != nil || size <= 0 {
+				return fsOpts, nil, fmt.Errorf("%w %q: size like 512M or 10G expected", ErrBadMountOption, opt)
+			}
+			fsOpts.CacheSize = size
+		default:
+			/* everything else is fuse business */
+			if key == "fsname" {
+				hasFsName = true
+			}
+			if key == "subtype" {
+				hasSubtype = true
+			}
+			fuseOpts = append(fuseOpts, opt)
+		}
+	}
+	/* shown in /proc/mounts as "<bucket> <mountpoint> fuse.ss3fs" */
+	if !hasFsName && bucket != "" {
+		fuseOpts = append(fuseOpts, "fsname="+bucket)
+	}
+	if !hasSubtype {
+		fuseOpts = append(fuseOpts, "subtype=ss3fs")
+	}
+	return fsOpts, []string{"-o", strings.Join(fuseOpts, ",")}, nil
+}
+
+/* size in bytes with optional K, M, G or T suffix */
+func parseSize(value string) (int64, error) {
+	shift := 0
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K', 'k':
+			shift = 10
+		case 'M', 'm':
+			shift = 20
+		case 'G', 'g':
+			shift = 30
+		case 'T', 't':
+			shift = 40
+		}
+	}
+	if shift != 0 {
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if size > math.MaxInt64>>shift {
+		return 0, strconv.ErrRange
+	}
+	return size << shift, nil
+}
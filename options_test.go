@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"ss3fs/ss3fs"
+	"testing"
+	"time"
+)
+
+func TestSplitMountOptions(t *testing.T) {
+	var opts mountOptions
+	opts.Set("uid=1000,gid=100,allow_other")
+	opts.Set("umask=027,max_read=131072")
+	fsOpts, fuseOpts, err := splitMountOptions(opts, "bucket")
+	if err != nil {
+		t.Errorf("Can't split options, error: %v\n", err)
+		return
+	}
+	if fsOpts.Uid != 1000 || fsOpts.Gid != 100 {
+		t.Errorf("Wrong owner %d:%d\n", fsOpts.Uid, fsOpts.Gid)
+	}
+	if fsOpts.FileMode != 0640 || fsOpts.DirMode != 0750 {
+		t.Errorf("Wrong modes %o %o\n", fsOpts.FileMode, fsOpts.DirMode)
+	}
+	expected := []string{"-o", "allow_other,max_read=131072,fsname=bucket,subtype=ss3fs"}
+	if !reflect.DeepEqual(fuseOpts, expected) {
+		t.Errorf("Wrong fuse options %v, expected %v\n", fuseOpts, expected)
+	}
+}
+
+func TestSplitMountOptionsFsName(t *testing.T) {
+	_, fuseOpts, err := splitMountOptions(mountOptions{"fsname=data", "subtype=s3"}, "bucket")
+	if err != nil {
+		t.Errorf("Can't split options, error: %v\n", err)
+		return
+	}
+	expected := []string{"-o", "fsname=data,subtype=s3"}
+	if !reflect.DeepEqual(fuseOpts, expected) {
+		t.Errorf("Wrong fuse options %v, expected %v\n", fuseOpts, expected)
+	}
+}
+
+func TestSplitMountOptionsBad(t *testing.T) {
+	for _, opt := range []string{"uid=root", "gid=-1", "umask=999", "umask=01000",
+		"meta_timeout=5", "data_timeout=-1s", "retries=0", "retry_jitter=2",
+		"cache_size=0", "cache_size=10X", "cache_size=99999999999T",
+		"offline_probe=0", "upload_workers=-1", "upload_budget=0", "poll_interval=1",
+		"consistency=strict", "meta_ttl=-1s", "conflict=merge", "lock_lease=1h30"} {
+		_, _, err := splitMountOptions(mountOptions{opt}, "bucket")
+		if !errors.Is(err, ErrBadMountOption) {
+			t.Errorf("Option %s was accepted, error: %v\n", opt, err)
+		}
+	}
+}
+
+func TestSplitMountOptionsRetry(t *testing.T) {
+	opts := mountOptions{"meta_timeout=5s", "data_timeout=0", "retries=5", "retry_backoff=50ms",
+		"retry_max_backoff=1m", "retry_jitter=0.5", "retry_codes=InternalError:XMinioServerNotInitialized"}
+	fsOpts, fuseOpts, err := splitMountOptions(opts, "")
+	if err != nil {
+		t.Errorf("Can't split options, error: %v\n", err)
+		return
+	}
+	if fsOpts.MetaTimeout != 5*time.Second || fsOpts.DataTimeout != 0 {
+		t.Errorf("Wrong timeouts %v %v\n", fsOpts.MetaTimeout, fsOpts.DataTimeout)
+	}
+	retry := fsOpts.Retry
+	if retry.MaxAttempts != 5 || retry.MinBackoff != 50*time.Millisecond || retry.MaxBackoff != time.Minute ||
+		retry.Jitter != 0.5 || len(retry.RetryableCodes) != 2 {
+		t.Errorf("Wrong retry policy %+v\n", retry)
+	}
+	if fuseOpts[1] != "subtype=ss3fs" {
+		t.Errorf("Retry options were passed to fuse %v\n", fuseOpts)
+	}
+}
+
+func TestSplitMountOptionsCache(t *testing.T) {
+	fsOpts, _, err := splitMountOptions(mountOptions{"cache_dir=/var/cache/ss3fs", "cache_size=512M", "offline", "offline_probe=1m",
+		"upload_workers=16", "upload_budget=1G", "poll_interval=30s", "poll_prefixes=logs/:data/",
+		"consistency=cto", "meta_ttl=1m", "conflict=sibling", "lock_lease=2m"}, "")
+	if err != nil {
+		t.Errorf("Can't split options, error: %v\n", err)
+		return
+	}
+	if fsOpts.CacheDir != "/var/cache/ss3fs" || fsOpts.CacheSize != 512<<20 {
+		t.Errorf("Wrong cache options %q %d\n", fsOpts.CacheDir, fsOpts.CacheSize)
+	}
+	if !fsOpts.Offline || fsOpts.OfflineProbe != time.Minute {
+		t.Errorf("Wrong offline options %v %v\n", fsOpts.Offline, fsOpts.OfflineProbe)
+	}
+	if fsOpts.UploadWorkers != 16 || fsOpts.UploadBudget != 1<<30 {
+		t.Errorf("Wrong upload options %d %d\n", fsOpts.UploadWorkers, fsOpts.UploadBudget)
+	}
+	if fsOpts.PollInterval != 30*time.Second || len(fsOpts.PollPrefixes) != 2 || fsOpts.PollPrefixes[1] != "data/" {
+		t.Errorf("Wrong poll options %v %v\n", fsOpts.PollInterval, fsOpts.PollPrefixes)
+	}
+	if fsOpts.Consistency != ss3fs.ConsistencyCloseToOpen || fsOpts.MetaTTL != time.Minute || fsOpts.Conflict != ss3fs.ConflictSibling {
+		t.Errorf("Wrong consistency options %s %v %s\n", fsOpts.Consistency, fsOpts.MetaTTL, fsOpts.Conflict)
+	}
+	if fsOpts.LockLease != 2*time.Minute {
+		t.Errorf("Wrong lock lease %v\n", fsOpts.LockLease)
+	}
+}
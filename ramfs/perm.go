@@ -0,0 +1,82 @@
+package ramfs
+
+/* permission checks, done by file system itself, */
+/* so they work without default_permissions mount option */
+
+import (
+	"os"
+	"strings"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+/* access(2) mask bits */
+const (
+	xOK = 1
+	wOK = 2
+	rOK = 4
+)
+
+/* uid and gid of process, that called current operation */
+func (fs *RamFs) context() (uint32, uint32) {
+	switch {
+	case fs.caller != nil:
+		return fs.caller()
+	case fs.mounted:
+		uid, gid, _ := fuse.Getcontext()
+		return uid, gid
+	}
+	return uint32(os.Getuid()), uint32(os.Getgid())
+}
+
+func (fs *RamFs) access(node *Node, mask uint32) int {
+	uid, gid := fs.context()
+	mode := node.stat.Mode
+	if uid == 0 {
+		/* root may execute only if someone may */
+		if mask&xOK != 0 && node.stat.Mode&fuse.S_IFMT == fuse.S_IFREG && mode&0111 == 0 {
+			return -fuse.EACCES
+		}
+		return 0
+	}
+	switch {
+	case uid == node.stat.Uid:
+		mode >>= 6
+	case gid == node.stat.Gid:
+		mode >>= 3
+	}
+	if mode&mask&7 != mask&7 {
+		return -fuse.EACCES
+	}
+	return 0
+}
+
+/* in sticky directory only owners of entry or directory may remove entry */
+func (fs *RamFs) sticky(parent *Node, node *Node) int {
+	if parent.stat.Mode&fuse.S_ISVTX == 0 {
+		return 0
+	}
+	uid, _ := fs.context()
+	if uid == 0 || uid == parent.stat.Uid || uid == node.stat.Uid {
+		return 0
+	}
+	return -fuse.EPERM
+}
+
+/* user namespace follows file permissions, trusted and security need root */
+func (fs *RamFs) xattrAccess(node *Node, name string, mask uint32) int {
+	namespace, _, _ := strings.Cut(name, ".")
+	switch namespace {
+	case "user":
+		if node.stat.Mode&fuse.S_IFMT != fuse.S_IFREG && !node.isDir() {
+			return -fuse.EPERM
+		}
+		return fs.access(node, mask)
+	case "trusted", "security":
+		if uid, _ := fs.context(); uid != 0 {
+			return -fuse.EPERM
+		}
+		return 0
+	}
+	return -fuse.ENOTSUP
+}
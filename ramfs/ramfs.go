@@ -1,15 +1,17 @@
 package ramfs
 
 /* Package, that was used to test fuse Api */
-/* It contains in memory fs, that allow user only to create, read and write files */
+/* Now it is in memory POSIX file system: directories, hard and symbolic links, */
+/* sparse files, xattrs and permissions. It is reference for ss3fs behaviour */
+/* and can be used as fast scratch mount */
 
 import (
 	"errors"
-	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"sort"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/winfsp/cgofuse/fuse"
 )
@@ -18,182 +20,749 @@ var (
 	ErrMountPointDoesntExist = errors.New("mounting bucket doesn't exist")
 )
 
+/* max length of file name, as in most linux file systems */
+const nameMax = 255
+
 type RamFs struct {
-	created map[string]*Node
-	opened  map[string]*Attrs
-	ino     uint64
-	ctime   fuse.Timespec
-	lock    sync.Mutex
+	root *Node
+	/* nodes with open handles, handle is inode number */
+	opened map[uint64]*Node
+	ino    uint64
+	lock   sync.Mutex
+	/* set by Init, caller can be asked from FUSE only when mounted */
+	mounted bool
+	/* caller of current operation, process user if nil */
+	caller func() (uid uint32, gid uint32)
 	fuse.FileSystemBase
 }
 
 type Node struct {
-	attr Attrs
-	ino  uint64
-	data string
-}
-
-type Attrs struct {
-	len   int64
-	mtime fuse.Timespec
-	ctime fuse.Timespec
-	atime fuse.Timespec
-	cnt   uint64
+	stat fuse.Stat_t
+	/* file content or symlink target */
+	data     []byte
+	children map[string]*Node
+	xattrs   map[string][]byte
+	/* open handles */
+	cnt uint64
 }
 
 func (fs *RamFs) FsInit() error {
-	var err error = nil
-	fs.ino = 1
-	fs.opened = make(map[string]*Attrs)
-	fs.created = make(map[string]*Node)
-	fs.ctime = fuse.NewTimespec(time.Now())
-	/* check if bucket exists */
-	return err
+	fs.ino = 0
+	fs.opened = make(map[uint64]*Node)
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	fs.root = fs.newNode(fuse.S_IFDIR|0777, uid, gid)
+	return nil
 }
 
-func (fs *RamFs) Readdir(path string,
-	fill func(name string, stat *fuse.Stat_t, ofst int64) bool,
-	ofst int64,
-	fh uint64) (errc int) {
+func (fs *RamFs) Init() {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
-	/* add check for file type (object or bucket) */
-	/* handle root directory in special way */
-	log.Printf("reading dir\n")
-	switch path {
-	case "/":
-		fill(".", nil, 0)
-		fill("..", nil, 0)
-		for name, node := range fs.created {
-			log.Printf("%s %v\n", name, *node)
-			fill(name[1:], nil, 0)
+	fs.mounted = true
+}
+
+func (fs *RamFs) newNode(mode uint32, uid uint32, gid uint32) *Node {
+	fs.ino++
+	now := fuse.Now()
+	node := &Node{
+		stat: fuse.Stat_t{
+			Ino:      fs.ino,
+			Mode:     mode,
+			Nlink:    1,
+			Uid:      uid,
+			Gid:      gid,
+			Atim:     now,
+			Mtim:     now,
+			Ctim:     now,
+			Birthtim: now,
+			Blksize:  4096,
+		},
+	}
+	if mode&fuse.S_IFMT == fuse.S_IFDIR {
+		node.stat.Nlink = 2
+		node.children = make(map[string]*Node)
+	}
+	return node
+}
+
+func (node *Node) isDir() bool {
+	return node.stat.Mode&fuse.S_IFMT == fuse.S_IFDIR
+}
+
+/* file content changed */
+func (node *Node) modified() {
+	node.stat.Mtim = fuse.Now()
+	node.stat.Ctim = node.stat.Mtim
+}
+
+func (node *Node) resize(size int64) {
+	if size <= int64(len(node.data)) {
+		node.data = node.data[:size]
+	} else {
+		/* sparse: gap is read as zeros */
+		node.data = append(node.data, make([]byte, size-int64(len(node.data)))...)
+	}
+	node.stat.Size = size
+	node.stat.Blocks = (size + 511) / 512
+}
+
+func split(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	return path[:i], path[i+1:]
+}
+
+/* find node by path, each directory on the way must be searchable */
+func (fs *RamFs) lookup(path string) (*Node, int) {
+	node := fs.root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
 		}
-	default:
-		/* add listing of directory objects */
+		if !node.isDir() {
+			return nil, -fuse.ENOTDIR
+		}
+		if errc := fs.access(node, xOK); errc != 0 {
+			return nil, errc
+		}
+		child, ok := node.children[name]
+		if !ok {
+			return nil, -fuse.ENOENT
+		}
+		node = child
+	}
+	return node, 0
+}
+
+/* find parent directory of path, it must be writable and searchable */
+func (fs *RamFs) lookupParent(path string) (*Node, string, int) {
+	dir, name := split(path)
+	parent, errc := fs.lookup(dir)
+	if errc != 0 {
+		return nil, "", errc
+	}
+	if !parent.isDir() {
+		return nil, "", -fuse.ENOTDIR
+	}
+	if len(name) > nameMax {
+		return nil, "", -fuse.ENAMETOOLONG
+	}
+	if errc := fs.access(parent, wOK|xOK); errc != 0 {
+		return nil, "", errc
+	}
+	return parent, name, 0
+}
+
+/* node for handle, handle keeps node alive after unlink */
+func (fs *RamFs) handle(path string, fh uint64) (*Node, int) {
+	if node, ok := fs.opened[fh]; ok {
+		return node, 0
+	}
+	return fs.lookup(path)
+}
+
+func (fs *RamFs) link(parent *Node, name string, node *Node) {
+	parent.children[name] = node
+	if node.isDir() {
+		parent.stat.Nlink++
+	}
+	node.stat.Ctim = fuse.Now()
+	parent.modified()
+}
+
+func (fs *RamFs) unlink(parent *Node, name string) {
+	node := parent.children[name]
+	delete(parent.children, name)
+	if node.isDir() {
+		parent.stat.Nlink--
+		node.stat.Nlink = 0
+	} else {
+		node.stat.Nlink--
+	}
+	node.stat.Ctim = fuse.Now()
+	parent.modified()
+}
+
+func (fs *RamFs) create(path string, mode uint32) (*Node, int) {
+	parent, name, errc := fs.lookupParent(path)
+	if errc != 0 {
+		return nil, errc
+	}
+	if _, ok := parent.children[name]; ok {
+		return nil, -fuse.EEXIST
+	}
+	uid, gid := fs.context()
+	/* setgid directory passes its group to new nodes */
+	if parent.stat.Mode&fuse.S_ISGID != 0 {
+		gid = parent.stat.Gid
+		if mode&fuse.S_IFMT == fuse.S_IFDIR {
+			mode |= fuse.S_ISGID
+		}
+	}
+	node := fs.newNode(mode, uid, gid)
+	fs.link(parent, name, node)
+	return node, 0
+}
+
+func (fs *RamFs) Statfs(path string, stat *fuse.Statfs_t) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	stat.Bsize = 4096
+	stat.Frsize = 4096
+	stat.Blocks = 1 << 20
+	stat.Bfree = stat.Blocks
+	stat.Bavail = stat.Blocks
+	stat.Files = 1 << 20
+	stat.Ffree = stat.Files - fs.ino
+	stat.Favail = stat.Ffree
+	stat.Namemax = nameMax
+	return 0
+}
+
+func (fs *RamFs) Mknod(path string, mode uint32, dev uint64) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	slog.Debug("creating a file", "path", path, "mode", mode)
+	if mode&fuse.S_IFMT == 0 {
+		mode |= fuse.S_IFREG
+	}
+	node, errc := fs.create(path, mode)
+	if errc == 0 {
+		node.stat.Rdev = dev
+	}
+	return errc
+}
+
+func (fs *RamFs) Mkdir(path string, mode uint32) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	slog.Debug("creating a directory", "path", path, "mode", mode)
+	_, errc = fs.create(path, fuse.S_IFDIR|mode&07777)
+	return errc
+}
+
+func (fs *RamFs) Unlink(path string) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	slog.Debug("removing a file", "path", path)
+	parent, name, errc := fs.lookupParent(path)
+	if errc != 0 {
+		return errc
+	}
+	node, ok := parent.children[name]
+	if !ok {
 		return -fuse.ENOENT
 	}
+	if node.isDir() {
+		return -fuse.EISDIR
+	}
+	if errc := fs.sticky(parent, node); errc != 0 {
+		return errc
+	}
+	fs.unlink(parent, name)
 	return 0
 }
 
-func (fs *RamFs) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
+func (fs *RamFs) Rmdir(path string) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	slog.Debug("removing a directory", "path", path)
+	if path == "/" {
+		return -fuse.EBUSY
+	}
+	parent, name, errc := fs.lookupParent(path)
+	if errc != 0 {
+		return errc
+	}
+	node, ok := parent.children[name]
+	if !ok {
+		return -fuse.ENOENT
+	}
+	if !node.isDir() {
+		return -fuse.ENOTDIR
+	}
+	if len(node.children) != 0 {
+		return -fuse.ENOTEMPTY
+	}
+	if errc := fs.sticky(parent, node); errc != 0 {
+		return errc
+	}
+	fs.unlink(parent, name)
+	return 0
+}
+
+func (fs *RamFs) Link(oldpath string, newpath string) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.lookup(oldpath)
+	if errc != 0 {
+		return errc
+	}
+	if node.isDir() {
+		return -fuse.EPERM
+	}
+	parent, name, errc := fs.lookupParent(newpath)
+	if errc != 0 {
+		return errc
+	}
+	if _, ok := parent.children[name]; ok {
+		return -fuse.EEXIST
+	}
+	node.stat.Nlink++
+	fs.link(parent, name, node)
+	return 0
+}
+
+func (fs *RamFs) Symlink(target string, newpath string) (errc int) {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
-	log.Printf("getting attrs of file %s\n", path)
-	stat.Uid = uint32(os.Getuid())
-	stat.Gid = uint32(os.Getgid())
-	switch path {
-	case "/":
-		stat.Mode = fuse.S_IFDIR | 0555
-		stat.Ctim = fs.ctime
-		stat.Mtim = fuse.NewTimespec(time.Now())
-		stat.Atim = fuse.NewTimespec(time.Now())
-		stat.Nlink = 1
+	node, errc := fs.create(newpath, fuse.S_IFLNK|0777)
+	if errc != 0 {
+		return errc
+	}
+	node.data = []byte(target)
+	node.stat.Size = int64(len(target))
+	return 0
+}
+
+func (fs *RamFs) Readlink(path string) (errc int, target string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.lookup(path)
+	if errc != 0 {
+		return errc, ""
+	}
+	if node.stat.Mode&fuse.S_IFMT != fuse.S_IFLNK {
+		return -fuse.EINVAL, ""
+	}
+	return 0, string(node.data)
+}
+
+func (fs *RamFs) Rename(oldpath string, newpath string) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	slog.Debug("renaming", "path", oldpath, "new_path", newpath)
+	if oldpath == "/" || newpath == "/" {
+		return -fuse.EBUSY
+	}
+	oldParent, oldName, errc := fs.lookupParent(oldpath)
+	if errc != 0 {
+		return errc
+	}
+	node, ok := oldParent.children[oldName]
+	if !ok {
+		return -fuse.ENOENT
+	}
+	newParent, newName, errc := fs.lookupParent(newpath)
+	if errc != 0 {
+		return errc
+	}
+	target, exists := newParent.children[newName]
+	if exists && target == node {
+		/* both names of one node, nothing to do */
 		return 0
+	}
+	/* directory can't be moved into itself */
+	if node.isDir() && strings.HasPrefix(newpath+"/", oldpath+"/") {
+		return -fuse.EINVAL
+	}
+	if errc := fs.sticky(oldParent, node); errc != 0 {
+		return errc
+	}
+	if exists {
+		switch {
+		case node.isDir() && !target.isDir():
+			return -fuse.ENOTDIR
+		case !node.isDir() && target.isDir():
+			return -fuse.EISDIR
+		case target.isDir() && len(target.children) != 0:
+			return -fuse.ENOTEMPTY
+		}
+		if errc := fs.sticky(newParent, target); errc != 0 {
+			return errc
+		}
+		fs.unlink(newParent, newName)
+	}
+	delete(oldParent.children, oldName)
+	if node.isDir() {
+		oldParent.stat.Nlink--
+	}
+	oldParent.modified()
+	fs.link(newParent, newName, node)
+	return 0
+}
+
+func (fs *RamFs) Chmod(path string, mode uint32) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.lookup(path)
+	if errc != 0 {
+		return errc
+	}
+	uid, gid := fs.context()
+	if uid != 0 && uid != node.stat.Uid {
+		return -fuse.EPERM
+	}
+	/* only group members may set setgid bit */
+	if uid != 0 && gid != node.stat.Gid {
+		mode &^= fuse.S_ISGID
+	}
+	node.stat.Mode = node.stat.Mode&fuse.S_IFMT | mode&07777
+	node.stat.Ctim = fuse.Now()
+	return 0
+}
+
+func (fs *RamFs) Chown(path string, uid uint32, gid uint32) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.lookup(path)
+	if errc != 0 {
+		return errc
+	}
+	callerUid, callerGid := fs.context()
+	/* -1 keeps the current value */
+	if uid == ^uint32(0) {
+		uid = node.stat.Uid
+	}
+	if gid == ^uint32(0) {
+		gid = node.stat.Gid
+	}
+	if callerUid != 0 {
+		/* owner may only change group to its own */
+		if callerUid != node.stat.Uid || uid != node.stat.Uid || (gid != node.stat.Gid && gid != callerGid) {
+			return -fuse.EPERM
+		}
+	}
+	if (uid != node.stat.Uid || gid != node.stat.Gid) && !node.isDir() {
+		node.stat.Mode &^= fuse.S_ISUID | fuse.S_ISGID
+	}
+	node.stat.Uid = uid
+	node.stat.Gid = gid
+	node.stat.Ctim = fuse.Now()
+	return 0
+}
+
+func (fs *RamFs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.lookup(path)
+	if errc != 0 {
+		return errc
+	}
+	uid, _ := fs.context()
+	if tmsp == nil {
+		/* setting current time needs write permission */
+		if uid != node.stat.Uid {
+			if errc := fs.access(node, wOK); errc != 0 {
+				return errc
+			}
+		}
+		now := fuse.Now()
+		tmsp = []fuse.Timespec{now, now}
+	} else if uid != 0 && uid != node.stat.Uid {
+		return -fuse.EPERM
+	}
+	node.stat.Atim = tmsp[0]
+	node.stat.Mtim = tmsp[1]
+	node.stat.Ctim = fuse.Now()
+	return 0
+}
+
+func (fs *RamFs) Access(path string, mask uint32) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.lookup(path)
+	if errc != 0 {
+		return errc
+	}
+	return fs.access(node, mask)
+}
+
+func (fs *RamFs) Create(path string, flags int, mode uint32) (errc int, fh uint64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	slog.Debug("creating a file", "path", path, "flags", flags, "mode", mode)
+	node, errc := fs.lookup(path)
+	switch {
+	case errc == 0 && flags&fuse.O_EXCL != 0:
+		return -fuse.EEXIST, ^uint64(0)
+	case errc == 0:
+		return fs.open(path, node, flags)
+	case errc != -fuse.ENOENT:
+		return errc, ^uint64(0)
+	}
+	node, errc = fs.create(path, fuse.S_IFREG|mode&07777)
+	if errc != 0 {
+		return errc, ^uint64(0)
+	}
+	/* new file is opened with any flags, whatever its mode is */
+	return fs.openHandle(node), node.stat.Ino
+}
+
+func (fs *RamFs) Open(path string, flags int) (errc int, fh uint64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.lookup(path)
+	if errc != 0 {
+		return errc, ^uint64(0)
+	}
+	return fs.open(path, node, flags)
+}
+
+func (fs *RamFs) open(path string, node *Node, flags int) (int, uint64) {
+	var mask uint32
+	switch flags & fuse.O_ACCMODE {
+	case fuse.O_RDONLY:
+		mask = rOK
+	case fuse.O_WRONLY:
+		mask = wOK
 	default:
-		node, ok := fs.created[path]
-		if ok {
-			stat.Mode = fuse.S_IFREG | 0777
-			stat.Mtim = node.attr.mtime
-			stat.Ctim = node.attr.ctime
-			stat.Atim = fuse.NewTimespec(time.Now())
-			stat.Size = node.attr.len
-			stat.Nlink = 1
-
-		} else {
-			log.Printf("object does not exist\n")
-			return -fuse.ENOENT
+		mask = rOK | wOK
+	}
+	if node.isDir() && mask&wOK != 0 {
+		return -fuse.EISDIR, ^uint64(0)
+	}
+	if errc := fs.access(node, mask); errc != 0 {
+		return errc, ^uint64(0)
+	}
+	if flags&fuse.O_TRUNC != 0 && mask&wOK != 0 && node.stat.Size != 0 {
+		node.resize(0)
+		node.modified()
+	}
+	return fs.openHandle(node), node.stat.Ino
+}
+
+func (fs *RamFs) openHandle(node *Node) int {
+	node.cnt++
+	fs.opened[node.stat.Ino] = node
+	return 0
+}
+
+func (fs *RamFs) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.handle(path, fh)
+	if errc != 0 {
+		return errc
+	}
+	*stat = node.stat
+	return 0
+}
+
+func (fs *RamFs) Truncate(path string, size int64, fh uint64) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if size < 0 {
+		return -fuse.EINVAL
+	}
+	node, errc := fs.handle(path, fh)
+	if errc != 0 {
+		return errc
+	}
+	if node.isDir() {
+		return -fuse.EISDIR
+	}
+	/* ftruncate was checked on open */
+	if _, ok := fs.opened[fh]; !ok {
+		if errc := fs.access(node, wOK); errc != 0 {
+			return errc
 		}
 	}
-	log.Printf("file ret 0")
+	node.resize(size)
+	node.modified()
 	return 0
 }
 
 func (fs *RamFs) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
-	log.Printf("reading file\n")
-	node, ok := fs.created[path]
-	if !ok {
-		return -fuse.ENOENT
+	node, errc := fs.handle(path, fh)
+	if errc != 0 {
+		return errc
 	}
-	endofst := ofst + int64(len(buff))
-	node.attr.atime = fuse.NewTimespec(time.Now())
-	if endofst > node.attr.len {
-		endofst = node.attr.len
+	if node.isDir() {
+		return -fuse.EISDIR
 	}
-	if ofst > node.attr.len {
-		return -fuse.EFAULT
+	if ofst < 0 {
+		return -fuse.EINVAL
 	}
-	log.Printf("%s\n", node.data[ofst:endofst])
-	n = copy(buff, node.data[ofst:endofst])
-	return n
+	node.stat.Atim = fuse.Now()
+	if ofst >= node.stat.Size {
+		return 0
+	}
+	return copy(buff, node.data[ofst:])
 }
 
 func (fs *RamFs) Write(path string, buff []byte, ofst int64, fh uint64) (n int) {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
-	log.Printf("writing into file\n")
-	node, ok := fs.created[path]
+	slog.Debug("writing into file", "path", path, "ofst", ofst, "len", len(buff))
+	node, errc := fs.handle(path, fh)
+	if errc != 0 {
+		return errc
+	}
+	if ofst < 0 {
+		return -fuse.EINVAL
+	}
+	if end := ofst + int64(len(buff)); end > node.stat.Size {
+		node.resize(end)
+	}
+	n = copy(node.data[ofst:], buff)
+	node.modified()
+	/* write by others drops setuid and setgid */
+	if uid, _ := fs.context(); uid != 0 {
+		node.stat.Mode &^= fuse.S_ISUID | fuse.S_ISGID
+	}
+	return n
+}
+
+func (fs *RamFs) Flush(path string, fh uint64) (errc int) {
+	return 0
+}
+
+func (fs *RamFs) Fsync(path string, datasync bool, fh uint64) (errc int) {
+	return 0
+}
+
+func (fs *RamFs) Release(path string, fh uint64) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, ok := fs.opened[fh]
 	if !ok {
-		return -fuse.ENOENT
+		return -fuse.EBADF
 	}
-	node.attr.atime = fuse.NewTimespec(time.Now())
-	if ofst > node.attr.len {
-		return -fuse.EFAULT
+	node.cnt--
+	if node.cnt == 0 {
+		delete(fs.opened, fh)
 	}
-	if node.attr.len > 0 {
-		node.data = node.data[:ofst]
+	return 0
+}
+
+func (fs *RamFs) Opendir(path string) (errc int, fh uint64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.lookup(path)
+	if errc != 0 {
+		return errc, ^uint64(0)
 	}
-	if node.data == "" {
-		node.data = string(buff)
-	} else {
-		node.data = node.data + string(buff)
+	if !node.isDir() {
+		return -fuse.ENOTDIR, ^uint64(0)
 	}
-	fmt.Printf("buff %s data %s, len %d\n", string(buff), node.data, int64(len(node.data)))
-	node.attr.len = int64(len(node.data))
-	return len(buff)
+	if errc := fs.access(node, rOK); errc != 0 {
+		return errc, ^uint64(0)
+	}
+	return fs.openHandle(node), node.stat.Ino
 }
 
-func (fs *RamFs) Mknod(path string, mode uint32, dev uint64) (errc int) {
+func (fs *RamFs) Readdir(path string,
+	fill func(name string, stat *fuse.Stat_t, ofst int64) bool,
+	ofst int64,
+	fh uint64) (errc int) {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
-	log.Printf("creating a file\n")
-	n := fs.created[path]
-	if n != nil {
-		log.Printf("file exists %s\n", path)
-		return -fuse.EEXIST
+	slog.Debug("reading dir", "path", path)
+	node, errc := fs.handle(path, fh)
+	if errc != 0 {
+		return errc
 	}
-	attr := Attrs{
-		len:   0,
-		mtime: fuse.NewTimespec(time.Now()),
-		ctime: fuse.NewTimespec(time.Now()),
-		atime: fuse.NewTimespec(time.Now()),
-		cnt:   1,
+	if !node.isDir() {
+		return -fuse.ENOTDIR
 	}
-	node := &Node{
-		attr: attr,
-		ino:  fs.ino,
-		data: "",
+	fill(".", &node.stat, 0)
+	fill("..", nil, 0)
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
 	}
-	fs.ino++
-	fs.created[path] = node
+	sort.Strings(names)
+	for _, name := range names {
+		stat := node.children[name].stat
+		if !fill(name, &stat, 0) {
+			break
+		}
+	}
+	node.stat.Atim = fuse.Now()
 	return 0
 }
 
-func (fs *RamFs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
+func (fs *RamFs) Releasedir(path string, fh uint64) (errc int) {
+	return fs.Release(path, fh)
+}
+
+func (fs *RamFs) Setxattr(path string, name string, value []byte, flags int) (errc int) {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
-	node, ok := fs.created[path]
+	node, errc := fs.lookup(path)
+	if errc != 0 {
+		return errc
+	}
+	if errc := fs.xattrAccess(node, name, wOK); errc != 0 {
+		return errc
+	}
+	_, ok := node.xattrs[name]
+	switch {
+	case ok && flags&fuse.XATTR_CREATE != 0:
+		return -fuse.EEXIST
+	case !ok && flags&fuse.XATTR_REPLACE != 0:
+		return -fuse.ENOATTR
+	}
+	if node.xattrs == nil {
+		node.xattrs = make(map[string][]byte)
+	}
+	node.xattrs[name] = append([]byte(nil), value...)
+	node.stat.Ctim = fuse.Now()
+	return 0
+}
+
+func (fs *RamFs) Getxattr(path string, name string) (errc int, value []byte) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.lookup(path)
+	if errc != 0 {
+		return errc, nil
+	}
+	if errc := fs.xattrAccess(node, name, rOK); errc != 0 {
+		return errc, nil
+	}
+	value, ok := node.xattrs[name]
 	if !ok {
-		return -fuse.ENOENT
+		return -fuse.ENOATTR, nil
 	}
-	node.attr.ctime = fuse.Now()
-	if tmsp == nil {
-		tmsp0 := node.attr.ctime
-		tmsa := [2]fuse.Timespec{tmsp0, tmsp0}
-		tmsp = tmsa[:]
+	return 0, value
+}
+
+func (fs *RamFs) Removexattr(path string, name string) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.lookup(path)
+	if errc != 0 {
+		return errc
+	}
+	if errc := fs.xattrAccess(node, name, wOK); errc != 0 {
+		return errc
+	}
+	if _, ok := node.xattrs[name]; !ok {
+		return -fuse.ENOATTR
+	}
+	delete(node.xattrs, name)
+	node.stat.Ctim = fuse.Now()
+	return 0
+}
+
+func (fs *RamFs) Listxattr(path string, fill func(name string) bool) (errc int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, errc := fs.lookup(path)
+	if errc != 0 {
+		return errc
+	}
+	names := make([]string, 0, len(node.xattrs))
+	for name := range node.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !fill(name) {
+			return -fuse.ERANGE
+		}
 	}
-	node.attr.atime = tmsp[0]
-	node.attr.mtime = tmsp[1]
 	return 0
 }
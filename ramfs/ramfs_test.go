@@ -0,0 +1,142 @@
+package ramfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func newTestFs(t *testing.T) *RamFs {
+	fs := &RamFs{}
+	if err := fs.FsInit(); err != nil {
+		t.Fatalf("Can't init file system, error: %v\n", err)
+	}
+	return fs
+}
+
+func TestSparseWriteTruncate(t *testing.T) {
+	fs := newTestFs(t)
+	errc, fh := fs.Create("/file", fuse.O_RDWR, 0644)
+	if errc != 0 {
+		t.Errorf("Can't create file, errc: %d\n", errc)
+		return
+	}
+	fs.Write("/file", []byte("head"), 0, fh)
+	fs.Write("/file", []byte("tail"), 8, fh)
+	/* overwrite keeps the rest of file */
+	fs.Write("/file", []byte("H"), 0, fh)
+	buff := make([]byte, 100)
+	n := fs.Read("/file", buff, 0, fh)
+	if !bytes.Equal(buff[:max(n, 0)], []byte("Head\x00\x00\x00\x00tail")) {
+		t.Errorf("Wrong read result %q\n", buff[:max(n, 0)])
+	}
+	if n := fs.Read("/file", buff, 100, fh); n != 0 {
+		t.Errorf("Read past the end returned %d\n", n)
+	}
+	fs.Truncate("/file", 2, ^uint64(0))
+	var stat fuse.Stat_t
+	if fs.Getattr("/file", &stat, fh); stat.Size != 2 {
+		t.Errorf("Wrong size after truncate %d\n", stat.Size)
+	}
+	/* unlinked file stays readable through handle */
+	fs.Unlink("/file")
+	if n := fs.Read("/file", buff, 0, fh); n != 2 || string(buff[:n]) != "He" {
+		t.Errorf("Wrong read of unlinked file %q\n", buff[:max(n, 0)])
+	}
+	fs.Release("/file", fh)
+	if errc := fs.Getattr("/file", &stat, ^uint64(0)); errc != -fuse.ENOENT {
+		t.Errorf("Unlinked file is still there, errc: %d\n", errc)
+	}
+}
+
+func TestDirsRenameLinks(t *testing.T) {
+	fs := newTestFs(t)
+	fs.Mkdir("/a", 0755)
+	fs.Mkdir("/a/b", 0755)
+	fs.Mknod("/a/b/f", fuse.S_IFREG|0644, 0)
+	if errc := fs.Rmdir("/a"); errc != -fuse.ENOTEMPTY {
+		t.Errorf("Removed non empty dir, errc: %d\n", errc)
+	}
+	if errc := fs.Rename("/a", "/a/b/c"); errc != -fuse.EINVAL {
+		t.Errorf("Moved dir into itself, errc: %d\n", errc)
+	}
+	if errc := fs.Rename("/a", "/a"); errc != 0 {
+		t.Errorf("Rename of dir onto itself failed, errc: %d\n", errc)
+	}
+	if errc := fs.Rename("/a/b", "/c"); errc != 0 {
+		t.Errorf("Can't rename dir, errc: %d\n", errc)
+	}
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/c/f", &stat, ^uint64(0)); errc != 0 {
+		t.Errorf("File wasn't moved with dir, errc: %d\n", errc)
+	}
+	if fs.Getattr("/a", &stat, ^uint64(0)); stat.Nlink != 2 {
+		t.Errorf("Wrong nlink of dir %d\n", stat.Nlink)
+	}
+	fs.Symlink("c/f", "/link")
+	if errc, target := fs.Readlink("/link"); errc != 0 || target != "c/f" {
+		t.Errorf("Wrong symlink %q, errc: %d\n", target, errc)
+	}
+	fs.Link("/c/f", "/hard")
+	if fs.Getattr("/hard", &stat, ^uint64(0)); stat.Nlink != 2 {
+		t.Errorf("Wrong nlink of file %d\n", stat.Nlink)
+	}
+	names := []string{}
+	fs.Readdir("/", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		names = append(names, name)
+		return true
+	}, 0, ^uint64(0))
+	if len(names) != 6 || names[2] != "a" || names[5] != "link" {
+		t.Errorf("Wrong listing %v\n", names)
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	fs := newTestFs(t)
+	fs.Mknod("/file", fuse.S_IFREG|0644, 0)
+	if errc := fs.Setxattr("/file", "user.a", []byte("1"), fuse.XATTR_REPLACE); errc != -fuse.ENOATTR {
+		t.Errorf("Replaced missing xattr, errc: %d\n", errc)
+	}
+	fs.Setxattr("/file", "user.a", []byte("1"), 0)
+	if errc := fs.Setxattr("/file", "user.a", []byte("2"), fuse.XATTR_CREATE); errc != -fuse.EEXIST {
+		t.Errorf("Created existing xattr, errc: %d\n", errc)
+	}
+	if errc, value := fs.Getxattr("/file", "user.a"); errc != 0 || string(value) != "1" {
+		t.Errorf("Wrong xattr %q, errc: %d\n", value, errc)
+	}
+	fs.Removexattr("/file", "user.a")
+	if errc, _ := fs.Getxattr("/file", "user.a"); errc != -fuse.ENOATTR {
+		t.Errorf("Xattr wasn't removed, errc: %d\n", errc)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	fs := newTestFs(t)
+	fs.caller = func() (uint32, uint32) { return 1000, 1000 }
+	fs.Mkdir("/dir", 0755)
+	fs.Mknod("/dir/file", fuse.S_IFREG|0600, 0)
+	fs.caller = func() (uint32, uint32) { return 1001, 1001 }
+	if errc, _ := fs.Open("/dir/file", fuse.O_RDONLY); errc != -fuse.EACCES {
+		t.Errorf("Other user opened private file, errc: %d\n", errc)
+	}
+	if errc := fs.Mknod("/dir/other", fuse.S_IFREG|0644, 0); errc != -fuse.EACCES {
+		t.Errorf("Other user created file, errc: %d\n", errc)
+	}
+	if errc := fs.Chmod("/dir/file", 0777); errc != -fuse.EPERM {
+		t.Errorf("Other user changed mode, errc: %d\n", errc)
+	}
+	fs.caller = func() (uint32, uint32) { return 1000, 1000 }
+	fs.Chmod("/dir", 0700)
+	fs.caller = func() (uint32, uint32) { return 1001, 1001 }
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/dir/file", &stat, ^uint64(0)); errc != -fuse.EACCES {
+		t.Errorf("Other user searched private dir, errc: %d\n", errc)
+	}
+	fs.caller = func() (uint32, uint32) { return 0, 0 }
+	if errc, fh := fs.Open("/dir/file", fuse.O_RDWR); errc != 0 {
+		t.Errorf("Root can't open file, errc: %d\n", errc)
+	} else {
+		fs.Release("/dir/file", fh)
+	}
+}
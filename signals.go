@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"ss3fs/ss3fs"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+/* exit code, if pending updates were dropped on shutdown */
+const exitDataLost = 3
+
+/* drains file system on SIGINT or SIGTERM and unmounts it afterwards */
+type shutdownHandler struct {
+	fs      *ss3fs.Ss3fs
+	host    *fuse.FileSystemHost
+	timeout time.Duration
+	sigc    chan os.Signal
+	lost    atomic.Bool
+}
+
+func newShutdownHandler(fs *ss3fs.Ss3fs, timeout time.Duration) *shutdownHandler {
+	return &shutdownHandler{
+		fs:      fs,
+		timeout: timeout,
+		sigc:    make(chan os.Signal, 2),
+	}
+}
+
+/* must be called from Init, cgofuse subscribes for the same signals right before it */
+/* and would unmount immediately, without waiting for pending uploads */
+func (h *shutdownHandler) start(host *fuse.FileSystemHost) {
+	h.host = host
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(h.sigc, syscall.SIGINT, syscall.SIGTERM)
+	go h.run()
+}
+
+func (h *shutdownHandler) run() {
+	sig, ok := <-h.sigc
+	if !ok {
+		return
+	}
+	slog.Info("shutting down, waiting for pending uploads", "signal", sig, "timeout", h.timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	go func() {
+		/* second signal means user doesn't want to wait */
+		select {
+		case <-h.sigc:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := h.fs.Shutdown(ctx)
+	if err != nil {
+		slog.Error("shutdown wasn't clean", "err", err)
+		h.lost.Store(true)
+	}
+	h.host.Unmount()
+}
+
+func (h *shutdownHandler) stop() {
+	signal.Stop(h.sigc)
+}
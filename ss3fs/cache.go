@@ -0,0 +1,219 @@
+package ss3fs
+
+/* Persistent cache of object blocks on local disk */
+/* Blocks are keyed by object key, ETag and block number, so a changed object */
+/* never hits stale blocks. Every block is one file, written under temporary name */
+/* and renamed when complete, so the index rebuilt from file names after remount */
+/* or crash has no broken entries. LRU order survives remount in file mtimes. */
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBadCacheSize = errors.New("cache size must be positive")
+)
+
+/* objects are cached in blocks of this size, the last one may be shorter */
+const cacheBlockSize int64 = 1024 * 1024
+
+/* suffix of blocks being written, left ones are removed on open */
+const cacheTmpSuffix = ".tmp"
+
+type cacheBlock struct {
+	name string
+	size int64
+}
+
+type BlockCache struct {
+	dir      string
+	capacity int64
+	lock     sync.Mutex
+	/* block file name to its element in lru, front is the most recent */
+	blocks map[string]*list.Element
+	lru    *list.List
+	size   int64
+}
+
+/* open cache in dir, blocks left by previous mounts are reused */
+func OpenBlockCache(dir string, capacity int64) (*BlockCache, error) {
+	if capacity <= 0 {
+		return nil, ErrBadCacheSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	cache := &BlockCache{
+		dir:      dir,
+		capacity: capacity,
+		blocks:   make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	type found struct {
+		block cacheBlock
+		used  time.Time
+	}
+	var blocks []found
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		/* block was being written during crash */
+		if strings.HasSuffix(path, cacheTmpSuffix) {
+			return os.Remove(path)
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, found{cacheBlock{name: entry.Name(), size: info.Size()}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan of cache dir failed: %w", err)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].used.Before(blocks[j].used) })
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for _, found := range blocks {
+		cache.blocks[found.block.name] = cache.lru.PushFront(&found.block)
+		cache.size += found.block.size
+	}
+	/* capacity may be smaller than in previous mount */
+	cache.evict()
+	return cache, nil
+}
+
+/* file name of block, hashes keep names short and safe */
+func blockName(key string, etag string, number int64) string {
+	keySum := sha256.Sum256([]byte(key))
+	etagSum := sha256.Sum256([]byte(etag))
+	return hex.EncodeToString(keySum[:16]) + "-" + hex.EncodeToString(etagSum[:8]) + "-" + strconv.FormatInt(number, 10)
+}
+
+/* blocks are spread over subdirectories to keep directories small */
+func (cache *BlockCache) path(name string) string {
+	return filepath.Join(cache.dir, name[:2], name)
+}
+
+/* cached block of object version, false if it isn't cached */
+func (cache *BlockCache) Get(key string, etag string, number int64) ([]byte, bool) {
+	name := blockName(key, etag, number)
+	cache.lock.Lock()
+	elem, ok := cache.blocks[name]
+	if ok {
+		cache.lru.MoveToFront(elem)
+	}
+	cache.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+	path := cache.path(name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		/* evicted meanwhile or removed by hand */
+		cache.remove(name)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+/* store block of object version, it may be evicted at once if cache is too small */
+func (cache *BlockCache) Put(key string, etag string, number int64, data []byte) error {
+	name := blockName(key, etag, number)
+	path := cache.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), name+".*"+cacheTmpSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		/* renamed block must have its content after crash */
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if elem, ok := cache.blocks[name]; ok {
+		/* concurrent read of the same block */
+		cache.lru.MoveToFront(elem)
+		return nil
+	}
+	cache.blocks[name] = cache.lru.PushFront(&cacheBlock{name: name, size: int64(len(data))})
+	cache.size += int64(len(data))
+	cache.evict()
+	return nil
+}
+
+/* remove blocks of all versions of object, returns number of removed blocks */
+func (cache *BlockCache) Invalidate(key string) int {
+	keySum := sha256.Sum256([]byte(key))
+	prefix := hex.EncodeToString(keySum[:16]) + "-"
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	removed := 0
+	for name, elem := range cache.blocks {
+		if strings.HasPrefix(name, prefix) {
+			cache.drop(elem)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (cache *BlockCache) remove(name string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if elem, ok := cache.blocks[name]; ok {
+		cache.drop(elem)
+	}
+}
+
+/* must be called under lock */
+func (cache *BlockCache) drop(elem *list.Element) {
+	block := cache.lru.Remove(elem).(*cacheBlock)
+	delete(cache.blocks, block.name)
+	cache.size -= block.size
+	os.Remove(cache.path(block.name))
+}
+
+/* remove least recently used blocks over capacity, must be called under lock */
+func (cache *BlockCache) evict() {
+	for cache.size > cache.capacity && cache.lru.Len() != 0 {
+		cache.drop(cache.lru.Back())
+	}
+}
+
+/* bytes of cached blocks */
+func (cache *BlockCache) Size() int64 {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.size
+}
@@ -0,0 +1,156 @@
+package ss3fs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func TestBlockCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := OpenBlockCache(dir, 30)
+	if err != nil {
+		t.Errorf("Can't open cache, error: %v\n", err)
+		return
+	}
+	for i, data := range []string{"0123456789", "abcdefghij", "ABCDEFGHIJ"} {
+		if err := cache.Put("key", "etag1", int64(i), []byte(data)); err != nil {
+			t.Errorf("Put failed, error: %v\n", err)
+			return
+		}
+	}
+	if data, ok := cache.Get("key", "etag1", 1); !ok || string(data) != "abcdefghij" {
+		t.Errorf("Wrong cached block %q %v\n", data, ok)
+	}
+	if _, ok := cache.Get("key", "etag2", 1); ok {
+		t.Errorf("Block of other ETag was found\n")
+	}
+	/* block 0 is the least recently used one */
+	cache.Put("other", "etag1", 0, []byte("xxxxxxxxxx"))
+	if _, ok := cache.Get("key", "etag1", 0); ok {
+		t.Errorf("Least recently used block wasn't evicted\n")
+	}
+	if cache.Size() != 30 {
+		t.Errorf("Cache size is %d, want 30\n", cache.Size())
+	}
+
+	/* interrupted write is dropped on remount, blocks are kept */
+	leftover := filepath.Join(dir, "ab", "block.1.tmp")
+	os.MkdirAll(filepath.Dir(leftover), 0700)
+	os.WriteFile(leftover, []byte("half"), 0600)
+	cache, err = OpenBlockCache(dir, 20)
+	if err != nil {
+		t.Errorf("Can't reopen cache, error: %v\n", err)
+		return
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("Temporary block was left, error: %v\n", err)
+	}
+	if cache.Size() != 20 {
+		t.Errorf("Reopened cache size is %d, want 20\n", cache.Size())
+	}
+	if data, ok := cache.Get("other", "etag1", 0); !ok || string(data) != "xxxxxxxxxx" {
+		t.Errorf("Block was lost on remount %q %v\n", data, ok)
+	}
+}
+
+func TestReadThroughCache(t *testing.T) {
+	cfg := &FaultConfig{}
+	opts := DefaultOptions()
+	opts.Faults = cfg
+	opts.Retry.MaxAttempts = 1
+	opts.CacheDir = t.TempDir()
+	fs, err := NewSs3fsWithStore(NewMemStore(), opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	content := bytes.Repeat([]byte("0123456789abcdef"), int(cacheBlockSize*5/2/16))
+	fs.Mknod("/f", fuse.S_IFREG|0644, 0)
+	if n := fs.Write("/f", content, 0, 0); n != len(content) {
+		t.Errorf("Write returned %d\n", n)
+		return
+	}
+	buff := make([]byte, len(content))
+	if n := fs.Read("/f", buff, 0, 0); n != len(content) || !bytes.Equal(buff, content) {
+		t.Errorf("First read returned %d\n", n)
+		return
+	}
+
+	/* object is read from cache only */
+	cfg.Rules = []*FaultRule{{Ops: []string{"GetRange"}, Error: "InternalError"}}
+	part := make([]byte, 100)
+	ofst := cacheBlockSize - 50
+	if n := fs.Read("/f", part, ofst, 0); n != 100 || !bytes.Equal(part, content[ofst:ofst+100]) {
+		t.Errorf("Cached read returned %d\n", n)
+	}
+	cfg.Rules = nil
+
+	/* changed object has other ETag */
+	fs.Write("/f", []byte("XY"), 0, 0)
+	if n := fs.Read("/f", part[:4], 0, 0); n != 4 || string(part[:4]) != "XY23" {
+		t.Errorf("Read after change returned %d %q\n", n, part[:4])
+	}
+}
+
+/* reads of open file use attributes of open, cached rereads don't go to store */
+func TestCachedRereadWithoutHead(t *testing.T) {
+	cfg := &FaultConfig{}
+	opts := DefaultOptions()
+	opts.Faults = cfg
+	opts.Retry.MaxAttempts = 1
+	opts.CacheDir = t.TempDir()
+	mem := NewMemStore()
+	putString(mem, "f", "cached content")
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	errc, fh := fs.Open("/f", fuse.O_RDONLY)
+	if errc != 0 {
+		t.Errorf("Open failed with %d\n", errc)
+		return
+	}
+	defer fs.Release("/f", fh)
+	buff := make([]byte, 64)
+	fs.Read("/f", buff, 0, fh)
+	cfg.Rules = []*FaultRule{{Ops: []string{"Head", "GetRange"}, Error: "InternalError"}}
+	if n := fs.Read("/f", buff, 0, fh); n != len("cached content") || string(buff[:n]) != "cached content" {
+		t.Errorf("Cached reread returned %d\n", n)
+	}
+}
+
+/* blocks of object changed after open aren't cached under the ETag of open */
+func TestCachedBlockOfChangedObject(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CacheDir = t.TempDir()
+	mem := NewMemStore()
+	putString(mem, "f", "old content")
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	_, fh := fs.Open("/f", fuse.O_RDONLY)
+	defer fs.Release("/f", fh)
+	old, _ := mem.Head(context.Background(), "f")
+	putString(mem, "f", "new content")
+	buff := make([]byte, 64)
+	if n := fs.Read("/f", buff, 0, fh); n != 11 || string(buff[:n]) != "new content" {
+		t.Errorf("Read of changed object returned %d %q\n", n, buff[:max(n, 0)])
+	}
+	if _, ok := fs.cache.Get("f", old.ETag, 0); ok {
+		t.Errorf("Block of changed object is cached under old ETag\n")
+	}
+	current, _ := mem.Head(context.Background(), "f")
+	if block, ok := fs.cache.Get("f", current.ETag, 0); !ok || string(block) != "new content" {
+		t.Errorf("Block isn't cached under new ETag %q\n", block)
+	}
+}
@@ -0,0 +1,84 @@
+package ss3fs
+
+/* Fallback for stores without conditional writes: once a store rejects them */
+/* as not implemented, conditions are checked by Head before the write. Another */
+/* client may still write the object between both requests. */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+type conditionStore struct {
+	ObjectStore
+	/* store answered conditional write with NotImplemented */
+	unsupported atomic.Bool
+	log         *slog.Logger
+}
+
+func (st *conditionStore) native(cond Condition) bool {
+	return cond != (Condition{}) && !st.unsupported.Load()
+}
+
+/* false and fallback from now on, if store can't do conditional writes */
+func (st *conditionStore) supported(err error) bool {
+	if errno(err) != -fuse.ENOTSUP {
+		return true
+	}
+	if !st.unsupported.Swap(true) {
+		st.log.Warn("store doesn't support conditional writes, they are checked before writing", "err", err)
+	}
+	return false
+}
+
+/* emulated condition, racy */
+func (st *conditionStore) check(ctx context.Context, key string, cond Condition) error {
+	if cond == (Condition{}) {
+		return nil
+	}
+	info, err := st.ObjectStore.Head(ctx, key)
+	switch {
+	case err == nil && cond.IfNoneMatch:
+		return fmt.Errorf("%w: %s exists", ErrPreconditionFailed, key)
+	case err == nil && cond.IfMatch != "" && info.ETag != cond.IfMatch:
+		return fmt.Errorf("%w: %s has ETag %s, not %s", ErrPreconditionFailed, key, info.ETag, cond.IfMatch)
+	case errors.Is(err, ErrNotExist) && cond.IfMatch == "":
+		return nil
+	}
+	return err
+}
+
+func (st *conditionStore) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, meta map[string]string, cond Condition) (string, error) {
+	if st.native(cond) {
+		etag, err := st.ObjectStore.Put(ctx, key, body, size, meta, cond)
+		if st.supported(err) {
+			return etag, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	if err := st.check(ctx, key, cond); err != nil {
+		return "", err
+	}
+	return st.ObjectStore.Put(ctx, key, body, size, meta, Condition{})
+}
+
+func (st *conditionStore) CompleteMultipart(ctx context.Context, key string, uploadID string, parts []CompletedPart, cond Condition) (string, error) {
+	if st.native(cond) {
+		etag, err := st.ObjectStore.CompleteMultipart(ctx, key, uploadID, parts, cond)
+		if st.supported(err) {
+			return etag, err
+		}
+	}
+	if err := st.check(ctx, key, cond); err != nil {
+		return "", err
+	}
+	return st.ObjectStore.CompleteMultipart(ctx, key, uploadID, parts, Condition{})
+}
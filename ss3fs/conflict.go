@@ -0,0 +1,115 @@
+package ss3fs
+
+/* Upload conflicts: staged changes are uploaded with If-Match of the ETag they */
+/* are based on, so a concurrent change by another host isn't overwritten */
+/* silently. The policy decides what happens then: fail keeps our changes staged */
+/* and reports ESTALE, overwrite uploads them anyway, sibling saves them next to */
+/* the object under a new name. Under fail, close uploads at once instead of */
+/* queueing, so the conflict reaches the application. Recovery and lock renewal */
+/* have nobody to report to, they save changes as sibling under fail too. */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	ConflictFail      = "fail"
+	ConflictOverwrite = "overwrite"
+	ConflictSibling   = "sibling"
+)
+
+var (
+	ErrBadConflictPolicy = errors.New("unknown conflict policy")
+	ErrConflict          = errors.New("object was changed by others")
+)
+
+func checkConflictPolicy(policy string) error {
+	switch policy {
+	/* empty is fail, like in zero Options */
+	case "", ConflictFail, ConflictOverwrite, ConflictSibling:
+		return nil
+	}
+	return fmt.Errorf("%w %q, %s, %s or %s expected", ErrBadConflictPolicy, policy,
+		ConflictFail, ConflictOverwrite, ConflictSibling)
+}
+
+/* conflicts are reported to application, uploads can't be left to workers */
+func (fs *Ss3fs) reportConflicts() bool {
+	return fs.opts.Conflict == "" || fs.opts.Conflict == ConflictFail
+}
+
+/* failed If-Match: object was changed, or removed */
+func conflicting(err error, rec *journalRecord) bool {
+	return errors.Is(err, ErrPreconditionFailed) || (rec.Base != "" && errors.Is(err, ErrNotExist))
+}
+
+/* name for changes conflicting with key, unique per host and second */
+func conflictName(key string) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s.conflict-%s-%s", key, host, time.Now().UTC().Format("20060102T150405Z"))
+}
+
+/* parts of upload to key are useless after conflict */
+func (fs *Ss3fs) abortConflicting(ctx context.Context, rec *journalRecord) error {
+	if rec.UploadID == "" {
+		return nil
+	}
+	if err := fs.store.AbortMultipart(ctx, rec.Key, rec.UploadID); err != nil {
+		fs.log.Warn("abort of conflicting upload failed", "key", rec.Key, "err", err)
+	}
+	rec.UploadID, rec.Parts = "", nil
+	return fs.journal.save(rec)
+}
+
+/* upload staged data of record and resolve conflict by policy, returns ETag */
+/* of uploaded object and sibling name, if changes were saved under it */
+/* report tells, if caller returns ErrConflict to application */
+func (fs *Ss3fs) uploadResolved(ctx context.Context, rec *journalRecord, file io.ReaderAt, size int64, report bool) (string, string, error) {
+	etag, err := fs.uploadFile(ctx, rec, file, size)
+	if !conflicting(err, rec) {
+		return etag, "", err
+	}
+	fs.metrics.addUploadConflict()
+	log := fs.log.With("key", rec.Key, "base", rec.Base, "policy", fs.opts.Conflict)
+	policy := fs.opts.Conflict
+	if policy != ConflictOverwrite && !report {
+		/* changes must not get lost silently */
+		policy = ConflictSibling
+	}
+	switch policy {
+	case ConflictOverwrite:
+		log.Warn("object was changed by others, overwriting it")
+		rec.Base = ""
+		if err := fs.journal.save(rec); err != nil {
+			return "", "", err
+		}
+		etag, err := fs.uploadFile(ctx, rec, file, size)
+		return etag, "", err
+	case ConflictSibling:
+		/* upload belongs to key, parts are uploaded again for sibling */
+		if err := fs.abortConflicting(ctx, rec); err != nil {
+			return "", "", err
+		}
+		sibling := &journalRecord{Key: conflictName(rec.Key)}
+		etag, err := fs.uploadFile(ctx, sibling, file, size)
+		if err != nil {
+			return "", "", err
+		}
+		log.Warn("object was changed by others, changes are saved under sibling", "sibling", sibling.Key)
+		return etag, sibling.Key, nil
+	default:
+		if err := fs.abortConflicting(ctx, rec); err != nil {
+			return "", "", err
+		}
+		log.Error("object was changed by others, changes stay staged", "err", err)
+		return "", "", fmt.Errorf("%w: %s: %v", ErrConflict, rec.Key, err)
+	}
+}
@@ -0,0 +1,265 @@
+package ss3fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+/* both stores must handle conditions alike */
+func TestConditionalWrites(t *testing.T) {
+	fs, _ := newS3TestFs(t)
+	for name, st := range map[string]ObjectStore{"mem": NewMemStore(), "s3": fs.store} {
+		ctx := context.Background()
+		put := func(data string, cond Condition) (string, error) {
+			return st.Put(ctx, "key", bytes.NewReader([]byte(data)), int64(len(data)), nil, cond)
+		}
+		if _, err := put("first", Condition{IfMatch: "\"abc\""}); !errors.Is(err, ErrNotExist) {
+			t.Errorf("%s: If-Match of missing object, error: %v\n", name, err)
+		}
+		etag, err := put("first", Condition{IfNoneMatch: true})
+		if err != nil {
+			t.Errorf("%s: Can't create object, error: %v\n", name, err)
+			return
+		}
+		if _, err := put("second", Condition{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+			t.Errorf("%s: If-None-Match of existing object, error: %v\n", name, err)
+		}
+		if _, err := put("second", Condition{IfMatch: "\"abc\""}); !errors.Is(err, ErrPreconditionFailed) {
+			t.Errorf("%s: If-Match of other ETag, error: %v\n", name, err)
+		}
+		if _, err := put("second", Condition{IfMatch: etag}); err != nil {
+			t.Errorf("%s: If-Match of current ETag, error: %v\n", name, err)
+		}
+		if data := storeContent(t, st, "key"); string(data) != "second" {
+			t.Errorf("%s: Wrong content %q\n", name, data)
+		}
+	}
+}
+
+/* host a writes, host b changes the object meanwhile, a closes */
+func concurrentWrite(t *testing.T, policy string) (*MemStore, *Ss3fs, int) {
+	mem := NewMemStore()
+	putString(mem, "f", "old")
+	var hosts [2]*Ss3fs
+	for i := range hosts {
+		opts := DefaultOptions()
+		opts.UploadWorkers = 0
+		opts.Conflict = policy
+		fs, err := NewSs3fsWithStore(mem, opts)
+		if err != nil {
+			t.Fatalf("Can't create file system, error: %v\n", err)
+		}
+		t.Cleanup(fs.Destroy)
+		hosts[i] = fs
+	}
+	a, b := hosts[0], hosts[1]
+	_, fh := a.Open("/f", fuse.O_RDWR)
+	a.Write("/f", []byte("from a"), 0, fh)
+	if errc := writeClosed(b, "/f", []byte("from b")); errc != 0 {
+		t.Fatalf("Write of b failed with %d\n", errc)
+	}
+	errc := a.Release("/f", fh)
+	return mem, a, errc
+}
+
+func TestUploadConflict(t *testing.T) {
+	mem, a, errc := concurrentWrite(t, ConflictFail)
+	if errc != -int(syscall.ESTALE) {
+		t.Errorf("Conflict was reported with %d\n", errc)
+	}
+	if data := storeContent(t, mem, "f"); string(data) != "from b" {
+		t.Errorf("Changes of others were overwritten %q\n", data)
+	}
+	/* changes aren't lost, they stay staged */
+	if sf := a.findStaged("f"); sf == nil || !sf.dirty {
+		t.Errorf("Conflicting changes were dropped\n")
+	}
+
+	mem, a, errc = concurrentWrite(t, ConflictOverwrite)
+	if errc != 0 {
+		t.Errorf("Overwrite failed with %d\n", errc)
+	}
+	if len(a.staged) != 0 {
+		t.Errorf("Staged file is left\n")
+	}
+	if data := storeContent(t, mem, "f"); string(data) != "from a" {
+		t.Errorf("Object wasn't overwritten %q\n", data)
+	}
+
+	mem, a, errc = concurrentWrite(t, ConflictSibling)
+	if errc != 0 {
+		t.Errorf("Save to sibling failed with %d\n", errc)
+	}
+	if len(a.staged) != 0 {
+		t.Errorf("Staged file is left\n")
+	}
+	if data := storeContent(t, mem, "f"); string(data) != "from b" {
+		t.Errorf("Changes of others were overwritten %q\n", data)
+	}
+	list, _ := mem.List(context.Background(), "f.conflict-", "", "")
+	if len(list.Objects) != 1 || !strings.HasPrefix(list.Objects[0].Key, "f.conflict-") {
+		t.Errorf("No sibling with changes %v\n", list.Objects)
+		return
+	}
+	if data := storeContent(t, mem, list.Objects[0].Key); string(data) != "from a" {
+		t.Errorf("Wrong sibling content %q\n", data)
+	}
+}
+
+/* close returns before queued upload finds conflict, changes go to sibling */
+func TestQueuedUploadConflict(t *testing.T) {
+	mem := NewMemStore()
+	putString(mem, "f", "old")
+	opts := DefaultOptions()
+	opts.Conflict = ConflictSibling
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	_, fh := fs.Open("/f", fuse.O_RDWR)
+	fs.Write("/f", []byte("queued"), 0, fh)
+	putString(mem, "f", "from others")
+	if errc := fs.Release("/f", fh); errc != 0 {
+		t.Errorf("Close failed with %d\n", errc)
+	}
+	fs.Sync(context.Background())
+	if data := storeContent(t, mem, "f"); string(data) != "from others" {
+		t.Errorf("Changes of others were overwritten %q\n", data)
+	}
+	list, _ := mem.List(context.Background(), "f.conflict-", "", "")
+	if len(list.Objects) != 1 {
+		t.Errorf("Queued changes were lost %v\n", list.Objects)
+		return
+	}
+	if data := storeContent(t, mem, list.Objects[0].Key); string(data) != "queued" {
+		t.Errorf("Wrong sibling content %q\n", data)
+	}
+}
+
+/* under fail, close doesn't leave the upload to workers and reports conflict */
+func TestConflictFailNotQueued(t *testing.T) {
+	mem := NewMemStore()
+	putString(mem, "f", "old")
+	fs, err := NewSs3fsWithStore(mem, DefaultOptions())
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	_, fh := fs.Open("/f", fuse.O_RDWR)
+	fs.Write("/f", []byte("changed"), 0, fh)
+	putString(mem, "f", "from others")
+	if errc := fs.Release("/f", fh); errc != -int(syscall.ESTALE) {
+		t.Errorf("Conflict was reported with %d\n", errc)
+	}
+	if data := storeContent(t, mem, "f"); string(data) != "from others" {
+		t.Errorf("Changes of others were overwritten %q\n", data)
+	}
+	list, _ := mem.List(context.Background(), "f.conflict-", "", "")
+	if len(list.Objects) != 0 {
+		t.Errorf("Reported conflict was saved as sibling %v\n", list.Objects)
+	}
+}
+
+/* object changed between open and first write conflicts too */
+func TestConflictSinceOpen(t *testing.T) {
+	mem := NewMemStore()
+	putString(mem, "f", "old")
+	opts := DefaultOptions()
+	opts.UploadWorkers = 0
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	_, fh := fs.Open("/f", fuse.O_RDWR)
+	putString(mem, "f", "from others")
+	fs.Write("/f", []byte("changed"), 0, fh)
+	if errc := fs.Release("/f", fh); errc != -int(syscall.ESTALE) {
+		t.Errorf("Conflict was reported with %d\n", errc)
+	}
+	if data := storeContent(t, mem, "f"); string(data) != "from others" {
+		t.Errorf("Changes of others were overwritten %q\n", data)
+	}
+
+	/* own uploads and renames don't conflict */
+	putString(mem, "g", "old")
+	_, fh = fs.Open("/g", fuse.O_RDWR)
+	fs.Write("/g", []byte("first"), 0, fh)
+	if errc := fs.Flush("/g", fh); errc != 0 {
+		t.Errorf("Flush failed with %d\n", errc)
+	}
+	if errc := fs.Rename("/g", "/h"); errc != 0 {
+		t.Errorf("Rename failed with %d\n", errc)
+	}
+	fs.Write("/h", []byte("second"), 0, fh)
+	if errc := fs.Release("/h", fh); errc != 0 {
+		t.Errorf("Close after own changes failed with %d\n", errc)
+	}
+	if data := storeContent(t, mem, "h"); string(data) != "second" {
+		t.Errorf("Wrong content after rename %q\n", data)
+	}
+}
+
+/* parts of conflicting multipart upload don't stay in bucket */
+func TestMultipartConflictAborted(t *testing.T) {
+	mem := NewMemStore()
+	putString(mem, "big", "old")
+	opts := DefaultOptions()
+	opts.UploadWorkers = 0
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	_, fh := fs.Open("/big", fuse.O_RDWR)
+	fs.Write("/big", make([]byte, partSize+1), 0, fh)
+	putString(mem, "big", "from others")
+	if errc := fs.Release("/big", fh); errc != -int(syscall.ESTALE) {
+		t.Errorf("Conflict was reported with %d\n", errc)
+	}
+	if len(mem.uploads) != 0 {
+		t.Errorf("Conflicting upload wasn't aborted, %d left\n", len(mem.uploads))
+	}
+	if sf := fs.findStaged("big"); sf == nil || sf.rec.UploadID != "" {
+		t.Errorf("Staged file lost or still refers to aborted upload\n")
+	}
+}
+
+func TestConflictAfterCrash(t *testing.T) {
+	mem := NewMemStore()
+	putString(mem, "f", "old")
+	opts := DefaultOptions()
+	opts.CacheDir = t.TempDir()
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	fs.Open("/f", fuse.O_RDWR)
+	fs.Write("/f", []byte("lost"), 0, 0)
+	fs.Destroy()
+	putString(mem, "f", "from others")
+	fs, err = NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system after crash, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	if rec := fs.Recovered(); len(rec) != 1 || rec[0].Status != RecoveryConflict {
+		t.Errorf("Wrong recovery results %v\n", rec)
+	}
+	if data := storeContent(t, mem, "f"); string(data) != "from others" {
+		t.Errorf("Recovery overwrote changes of others %q\n", data)
+	}
+}
@@ -0,0 +1,92 @@
+package ss3fs
+
+/* Consistency modes: with ttl, cached metadata is trusted for MetaTTL (or until */
+/* polling or notifications invalidate it) and closed files are uploaded in the */
+/* background. With cto (close-to-open), open revalidates the object with the store */
+/* and close returns once the content is uploaded, so the next open on any host */
+/* sees it. */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ConsistencyTTL         = "ttl"
+	ConsistencyCloseToOpen = "cto"
+)
+
+var (
+	ErrBadConsistency = errors.New("unknown consistency mode")
+)
+
+func checkConsistency(mode string) error {
+	switch mode {
+	/* empty is ttl, like in zero Options */
+	case "", ConsistencyTTL, ConsistencyCloseToOpen:
+		return nil
+	}
+	return fmt.Errorf("%w %q, %s or %s expected", ErrBadConsistency, mode, ConsistencyTTL, ConsistencyCloseToOpen)
+}
+
+func (fs *Ss3fs) closeToOpen() bool {
+	return fs.opts.Consistency == ConsistencyCloseToOpen
+}
+
+/* metadata is served from cache, if polling, notifications or TTL keep it fresh */
+func (fs *Ss3fs) metaCached() bool {
+	return fs.opts.PollInterval > 0 || fs.opts.Notifications || fs.opts.MetaTTL > 0
+}
+
+/* age of trusted metadata of key, 0 trusts it until it is invalidated, */
+/* false if it isn't cached: keys out of polled prefixes rely on TTL */
+func (fs *Ss3fs) metaMaxAge(key string) (time.Duration, bool) {
+	if fs.opts.Notifications || (fs.opts.PollInterval > 0 && fs.polled(key)) {
+		return 0, true
+	}
+	return fs.opts.MetaTTL, fs.opts.MetaTTL > 0
+}
+
+/* attributes of object, from cache while it is fresh */
+func (fs *Ss3fs) lookup(ctx context.Context, name string, attr *Attrs) (bool, error) {
+	fs.touch(name)
+	if fs.lockFile(name) {
+		return fs.lookupLock(ctx, name, attr)
+	}
+	if !fs.metaCached() {
+		return fs.objectExist(ctx, name, attr)
+	}
+	maxAge, cached := fs.metaMaxAge(name)
+	if !cached {
+		return fs.objectExist(ctx, name, attr)
+	}
+	info, ok := fs.meta.fresh(name, maxAge)
+	fs.metrics.cacheLookup("stat", ok)
+	if !ok {
+		return fs.objectExist(ctx, name, attr)
+	}
+	if attr != nil {
+		attr.setInfo(info)
+	}
+	return true, nil
+}
+
+/* attributes of object to open, from store in close-to-open mode */
+/* blocks of a changed object are dropped */
+func (fs *Ss3fs) revalidate(ctx context.Context, name string, attr *Attrs) (bool, error) {
+	if !fs.closeToOpen() {
+		return fs.lookup(ctx, name, attr)
+	}
+	fs.touch(name)
+	old, known := fs.meta.recall(name)
+	exists, err := fs.objectExist(ctx, name, attr)
+	if err != nil {
+		return false, err
+	}
+	if known && (!exists || old.ETag != attr.etag) {
+		fs.remoteChange(name, "open")
+	}
+	return exists, nil
+}
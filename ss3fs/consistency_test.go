@@ -0,0 +1,101 @@
+package ss3fs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+/* two mounts of one bucket, like on two hosts */
+func newHosts(t *testing.T, consistency string, ttl time.Duration) (*Ss3fs, *Ss3fs) {
+	mem := NewMemStore()
+	putString(mem, "f", "old")
+	var hosts [2]*Ss3fs
+	for i := range hosts {
+		opts := DefaultOptions()
+		opts.CacheDir = t.TempDir()
+		opts.Consistency = consistency
+		opts.MetaTTL = ttl
+		fs, err := NewSs3fsWithStore(mem, opts)
+		if err != nil {
+			t.Fatalf("Can't create file system, error: %v\n", err)
+		}
+		t.Cleanup(fs.Destroy)
+		hosts[i] = fs
+	}
+	return hosts[0], hosts[1]
+}
+
+/* open, read all and close */
+func readFile(fs *Ss3fs, path string) string {
+	errc, fh := fs.Open(path, fuse.O_RDONLY)
+	if errc != 0 {
+		return ""
+	}
+	defer fs.Release(path, fh)
+	buff := make([]byte, 64)
+	n := fs.Read(path, buff, 0, fh)
+	return string(buff[:max(n, 0)])
+}
+
+func TestCloseToOpen(t *testing.T) {
+	writer, reader := newHosts(t, ConsistencyCloseToOpen, time.Hour)
+	if data := readFile(reader, "/f"); data != "old" {
+		t.Errorf("First read returned %q\n", data)
+	}
+	if errc := writeClosed(writer, "/f", []byte("new content")); errc != 0 {
+		t.Errorf("Write and close failed with %d\n", errc)
+		return
+	}
+	/* closed on writer, so the next open anywhere sees it */
+	if data := readFile(reader, "/f"); data != "new content" {
+		t.Errorf("Open after close read %q\n", data)
+	}
+	if reader.cache.Size() != int64(len("new content")) {
+		t.Errorf("Stale blocks weren't dropped, cache has %d bytes\n", reader.cache.Size())
+	}
+}
+
+/* open while this host has the file open already sees remote changes too */
+func TestCloseToOpenSecondHandle(t *testing.T) {
+	writer, reader := newHosts(t, ConsistencyCloseToOpen, time.Hour)
+	errc, fh := reader.Open("/f", fuse.O_RDONLY)
+	if errc != 0 {
+		t.Errorf("Open failed with %d\n", errc)
+		return
+	}
+	defer reader.Release("/f", fh)
+	if errc := writeClosed(writer, "/f", []byte("new content")); errc != 0 {
+		t.Errorf("Write and close failed with %d\n", errc)
+		return
+	}
+	if data := readFile(reader, "/f"); data != "new content" {
+		t.Errorf("Second open read %q\n", data)
+	}
+}
+
+func TestMetaTTL(t *testing.T) {
+	writer, reader := newHosts(t, ConsistencyTTL, 100*time.Millisecond)
+	readFile(reader, "/f")
+	writeClosed(writer, "/f", []byte("new content"))
+	writer.Sync(context.Background())
+	/* trusted until TTL passes */
+	if data := readFile(reader, "/f"); data != "old" {
+		t.Errorf("Read within TTL returned %q\n", data)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if data := readFile(reader, "/f"); data != "new content" {
+		t.Errorf("Read after TTL returned %q\n", data)
+	}
+}
+
+func TestBadConsistency(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Consistency = "strict"
+	if _, err := NewSs3fsWithStore(NewMemStore(), opts); !errors.Is(err, ErrBadConsistency) {
+		t.Errorf("Unknown consistency mode was accepted, error: %v\n", err)
+	}
+}
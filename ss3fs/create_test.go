@@ -0,0 +1,70 @@
+package ss3fs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func TestExclusiveCreate(t *testing.T) {
+	mem := NewMemStore()
+	var hosts [2]*Ss3fs
+	for i := range hosts {
+		fs, err := NewSs3fsWithStore(mem, DefaultOptions())
+		if err != nil {
+			t.Errorf("Can't create file system, error: %v\n", err)
+			return
+		}
+		defer fs.Destroy()
+		hosts[i] = fs
+	}
+	a, b := hosts[0], hosts[1]
+	errc, fh := a.Create("/lock", fuse.O_CREAT|fuse.O_EXCL|fuse.O_RDWR, 0644)
+	if errc != 0 {
+		t.Errorf("Create failed with %d\n", errc)
+		return
+	}
+	a.Write("/lock", []byte("a"), 0, fh)
+	a.Release("/lock", fh)
+	a.Sync(context.Background())
+	/* both hosts saw no file before */
+	if errc, _ := b.Create("/lock", fuse.O_CREAT|fuse.O_EXCL|fuse.O_RDWR, 0644); errc != -fuse.EEXIST {
+		t.Errorf("Exclusive create of existing file returned %d\n", errc)
+	}
+	errc, fh = b.Create("/lock", fuse.O_CREAT|fuse.O_RDWR, 0644)
+	if errc != 0 {
+		t.Errorf("Create without O_EXCL of existing file returned %d\n", errc)
+		return
+	}
+	b.Release("/lock", fh)
+	if data := storeContent(t, mem, "lock"); string(data) != "a" {
+		t.Errorf("Create replaced existing content %q\n", data)
+	}
+	if errc := b.Mknod("/lock", fuse.S_IFREG|0644, 0); errc != -fuse.EEXIST {
+		t.Errorf("Mknod of existing file returned %d\n", errc)
+	}
+}
+
+func TestCreateWithoutConditions(t *testing.T) {
+	fs, srv := newS3TestFs(t)
+	srv.DisableConditions()
+	srv.PutObject("bucket", "existing", []byte("data"))
+	if errc, _ := fs.Create("/existing", fuse.O_CREAT|fuse.O_EXCL|fuse.O_RDWR, 0644); errc != -fuse.EEXIST {
+		t.Errorf("Exclusive create of existing file returned %d\n", errc)
+	}
+	errc, fh := fs.Create("/new", fuse.O_CREAT|fuse.O_EXCL|fuse.O_RDWR, 0644)
+	if errc != 0 {
+		t.Errorf("Create failed with %d\n", errc)
+		return
+	}
+	/* upload with If-Match falls back too */
+	fs.Write("/new", []byte("content"), 0, fh)
+	if errc := fs.Fsync("/new", false, fh); errc != 0 {
+		t.Errorf("Upload failed with %d\n", errc)
+	}
+	fs.Release("/new", fh)
+	if data, _ := srv.Object("bucket", "new"); string(data) != "content" {
+		t.Errorf("Wrong object content %q\n", data)
+	}
+}
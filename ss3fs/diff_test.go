@@ -0,0 +1,297 @@
+package ss3fs
+
+/* differential test: random operation sequences are run on Ss3fs */
+/* and on ramfs, results and file contents must be the same */
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"ss3fs/internal/s3test"
+	"ss3fs/ramfs"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+var (
+	diffSeed  = flag.Int64("diff.seed", 0, "seed of differential test, random if 0")
+	diffRuns  = flag.Int("diff.runs", 10, "number of sequences in differential test")
+	diffSteps = flag.Int("diff.steps", 40, "operations in one sequence")
+)
+
+/* small name pool, so operations collide */
+var diffNames = []string{"a", "b", "c", "d"}
+
+type diffKind int
+
+const (
+	opCreate diffKind = iota
+	opWrite
+	opRead
+	opTruncate
+	opRename
+	opUnlink
+	opReaddir
+	/* handle held across operations */
+	opOpen
+	opClose
+	opKinds
+)
+
+type diffOp struct {
+	kind    diffKind
+	name    string
+	newName string
+	ofst    int64
+	size    int64
+	data    []byte
+}
+
+func (op diffOp) String() string {
+	switch op.kind {
+	case opCreate:
+		return fmt.Sprintf("create %s", op.name)
+	case opWrite:
+		return fmt.Sprintf("write %s ofst %d len %d", op.name, op.ofst, len(op.data))
+	case opRead:
+		return fmt.Sprintf("read %s ofst %d len %d", op.name, op.ofst, op.size)
+	case opTruncate:
+		return fmt.Sprintf("truncate %s size %d", op.name, op.size)
+	case opRename:
+		return fmt.Sprintf("rename %s %s", op.name, op.newName)
+	case opUnlink:
+		return fmt.Sprintf("unlink %s", op.name)
+	case opOpen:
+		return fmt.Sprintf("open %s", op.name)
+	case opClose:
+		return fmt.Sprintf("close held handle %d", op.ofst)
+	}
+	return "readdir"
+}
+
+func randomOps(rnd *rand.Rand, steps int) []diffOp {
+	ops := make([]diffOp, steps)
+	for i := range ops {
+		op := diffOp{
+			kind:    diffKind(rnd.Intn(int(opKinds))),
+			name:    diffNames[rnd.Intn(len(diffNames))],
+			newName: diffNames[rnd.Intn(len(diffNames))],
+			ofst:    rnd.Int63n(3 * 4096),
+			size:    rnd.Int63n(2 * 4096),
+		}
+		if op.kind == opWrite {
+			op.data = make([]byte, 1+rnd.Intn(4096))
+			rnd.Read(op.data)
+		}
+		ops[i] = op
+	}
+	return ops
+}
+
+/* result of one operation */
+type diffResult struct {
+	errc int
+	data []byte
+}
+
+func (res diffResult) String() string {
+	return fmt.Sprintf("errc %d, %d bytes", res.errc, len(res.data))
+}
+
+/* file system under test with handles held across operations */
+type diffFs struct {
+	fs   fuse.FileSystemInterface
+	held []diffHandle
+}
+
+type diffHandle struct {
+	fh uint64
+	/* follows renames like in the kernel, last name of removed file */
+	path string
+}
+
+/* renamed file takes its handles along */
+func (d *diffFs) renamed(path string, newPath string) {
+	for i := range d.held {
+		if d.held[i].path == path {
+			d.held[i].path = newPath
+		}
+	}
+}
+
+/* release handles left open by sequence */
+func (d *diffFs) releaseAll() {
+	for _, h := range d.held {
+		d.fs.Release(h.path, h.fh)
+	}
+	d.held = nil
+}
+
+func applyOp(d *diffFs, op diffOp) diffResult {
+	fs := d.fs
+	path := "/" + op.name
+	switch op.kind {
+	case opCreate:
+		return diffResult{errc: fs.Mknod(path, fuse.S_IFREG|0644, 0)}
+	case opWrite:
+		errc, fh := fs.Open(path, fuse.O_RDWR)
+		if errc != 0 {
+			return diffResult{errc: errc}
+		}
+		defer fs.Release(path, fh)
+		return diffResult{errc: fs.Write(path, op.data, op.ofst, fh)}
+	case opRead:
+		errc, fh := fs.Open(path, fuse.O_RDONLY)
+		if errc != 0 {
+			return diffResult{errc: errc}
+		}
+		defer fs.Release(path, fh)
+		buff := make([]byte, op.size)
+		n := fs.Read(path, buff, op.ofst, fh)
+		return diffResult{errc: n, data: buff[:max(n, 0)]}
+	case opTruncate:
+		return diffResult{errc: fs.Truncate(path, op.size, ^uint64(0))}
+	case opRename:
+		errc := fs.Rename(path, "/"+op.newName)
+		if errc == 0 && op.name != op.newName {
+			d.renamed(path, "/"+op.newName)
+		}
+		return diffResult{errc: errc}
+	case opUnlink:
+		return diffResult{errc: fs.Unlink(path)}
+	case opOpen:
+		errc, fh := fs.Open(path, fuse.O_RDWR)
+		if errc == 0 {
+			d.held = append(d.held, diffHandle{fh: fh, path: path})
+		}
+		return diffResult{errc: errc}
+	case opClose:
+		if len(d.held) == 0 {
+			return diffResult{}
+		}
+		i := int(op.ofst) % len(d.held)
+		h := d.held[i]
+		d.held = append(d.held[:i], d.held[i+1:]...)
+		return diffResult{errc: fs.Release(h.path, h.fh)}
+	}
+	names := []string{}
+	errc := fs.Readdir("/", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if name != "." && name != ".." {
+			names = append(names, name)
+		}
+		return true
+	}, 0, ^uint64(0))
+	sort.Strings(names)
+	return diffResult{errc: errc, data: []byte(strings.Join(names, "/"))}
+}
+
+/* whole state of the file system: size and content of each name */
+func snapshot(fs fuse.FileSystemInterface) string {
+	var state strings.Builder
+	for _, name := range diffNames {
+		var stat fuse.Stat_t
+		if errc := fs.Getattr("/"+name, &stat, ^uint64(0)); errc != 0 {
+			fmt.Fprintf(&state, "%s: errc %d\n", name, errc)
+			continue
+		}
+		res := applyOp(&diffFs{fs: fs}, diffOp{kind: opRead, name: name, size: stat.Size + 1})
+		fmt.Fprintf(&state, "%s: size %d, %s, %x\n", name, stat.Size, res, res.data)
+	}
+	return state.String()
+}
+
+/* run ops on fresh file systems, returns index of first diverged op or -1 */
+func runDiff(t *testing.T, ops []diffOp) (int, string) {
+	srv := s3test.NewServer("bucket")
+	defer srv.Close()
+	acc, sec, region, bucket := "test", "test", "us-east-1", "bucket"
+	s3fs, err := NewSs3fs(&acc, &sec, &region, &bucket, &srv.URL, DefaultOptions())
+	if err != nil {
+		t.Fatalf("Can't create file system, error: %v\n", err)
+	}
+	defer s3fs.Destroy()
+	ram := &ramfs.RamFs{}
+	ram.FsInit()
+	want, got := &diffFs{fs: ram}, &diffFs{fs: s3fs}
+	defer want.releaseAll()
+	defer got.releaseAll()
+
+	for i, op := range ops {
+		want := applyOp(want, op)
+		got := applyOp(got, op)
+		if want.errc != got.errc || !bytes.Equal(want.data, got.data) {
+			return i, fmt.Sprintf("%v: ramfs %v, ss3fs %v", op, want, got)
+		}
+		if want, got := snapshot(ram), snapshot(s3fs); want != got {
+			return i, fmt.Sprintf("%v: state differs\nramfs:\n%sss3fs:\n%s", op, want, got)
+		}
+	}
+	return -1, ""
+}
+
+/* drop operations and simplify them while sequence still fails */
+func shrinkOps(t *testing.T, ops []diffOp) []diffOp {
+	fails := func(ops []diffOp) bool {
+		i, _ := runDiff(t, ops)
+		return i >= 0
+	}
+	i, _ := runDiff(t, ops)
+	ops = ops[:i+1]
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		for start := 0; start+chunk <= len(ops); {
+			candidate := append(append([]diffOp{}, ops[:start]...), ops[start+chunk:]...)
+			if fails(candidate) {
+				ops = candidate
+			} else {
+				start += chunk
+			}
+		}
+	}
+	for i := range ops {
+		for _, simpler := range []diffOp{
+			{kind: ops[i].kind, name: ops[i].name, newName: ops[i].newName, ofst: 0, size: ops[i].size, data: ops[i].data},
+			{kind: ops[i].kind, name: ops[i].name, newName: ops[i].newName, ofst: ops[i].ofst, size: 1, data: ops[i].data[:min(len(ops[i].data), 1)]},
+		} {
+			candidate := append([]diffOp{}, ops...)
+			candidate[i] = simpler
+			if fails(candidate) {
+				ops = candidate
+			}
+		}
+	}
+	return ops
+}
+
+func TestDifferential(t *testing.T) {
+	seed := *diffSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	runs := *diffRuns
+	if testing.Short() {
+		runs = 2
+	}
+	/* reproducible even if the test hangs or crashes */
+	t.Logf("-diff.seed=%d\n", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	for run := 0; run < runs; run++ {
+		ops := randomOps(rnd, *diffSteps)
+		if i, _ := runDiff(t, ops); i < 0 {
+			continue
+		}
+		ops = shrinkOps(t, ops)
+		_, diff := runDiff(t, ops)
+		steps := make([]string, len(ops))
+		for i, op := range ops {
+			steps[i] = op.String()
+		}
+		t.Errorf("Ss3fs diverged from ramfs, -diff.seed=%d, minimal sequence:\n%s\n%s\n", seed, strings.Join(steps, "\n"), diff)
+		return
+	}
+}
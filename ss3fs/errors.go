@@ -0,0 +1,110 @@
+package ss3fs
+
+/* One place, where store and local errors become errno values */
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+/* errno by S3 error code */
+var s3Errnos = map[string]int{
+	"AccessDenied":          fuse.EACCES,
+	"AllAccessDisabled":     fuse.EACCES,
+	"AccountProblem":        fuse.EACCES,
+	"InvalidAccessKeyId":    fuse.EACCES,
+	"SignatureDoesNotMatch": fuse.EACCES,
+	"ExpiredToken":          fuse.EACCES,
+	"InvalidObjectState":    fuse.EACCES,
+	"NoSuchBucket":          fuse.ENODEV,
+	"NoSuchKey":             fuse.ENOENT,
+	"NotFound":              fuse.ENOENT,
+	"NoSuchUpload":          fuse.ENOENT,
+	"SlowDown":              fuse.EAGAIN,
+	"ServiceUnavailable":    fuse.EAGAIN,
+	"Throttling":            fuse.EAGAIN,
+	"RequestLimitExceeded":  fuse.EAGAIN,
+	"TooManyRequests":       fuse.EAGAIN,
+	"EntityTooLarge":        fuse.EFBIG,
+	"KeyTooLongError":       fuse.ENAMETOOLONG,
+	"PreconditionFailed":    int(syscall.ESTALE),
+	/* concurrent conditional write of the same key */
+	"ConditionalRequestConflict":     fuse.EAGAIN,
+	"RequestTimeout":                 fuse.ETIMEDOUT,
+	"QuotaExceeded":                  int(syscall.EDQUOT),
+	"XMinioAdminBucketQuotaExceeded": int(syscall.EDQUOT),
+	"XMinioStorageFull":              fuse.ENOSPC,
+	"NotImplemented":                 fuse.ENOTSUP,
+	"InvalidRange":                   fuse.EINVAL,
+}
+
+/* errno by HTTP status, if error code is unknown, e.g. for HEAD requests */
+var statusErrnos = map[int]int{
+	400: fuse.EINVAL,
+	403: fuse.EACCES,
+	404: fuse.ENOENT,
+	408: fuse.ETIMEDOUT,
+	412: int(syscall.ESTALE),
+	413: fuse.EFBIG,
+	416: fuse.EINVAL,
+	429: fuse.EAGAIN,
+	501: fuse.ENOTSUP,
+	503: fuse.EAGAIN,
+	504: fuse.ETIMEDOUT,
+}
+
+/* negative errno for error of store or local file, EIO if nothing better is known */
+func errno(err error) int {
+	if err == nil {
+		return 0
+	}
+	if errors.Is(err, ErrNotExist) || errors.Is(err, ErrNoSuchUpload) {
+		return -fuse.ENOENT
+	}
+	if errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrConflict) {
+		return -int(syscall.ESTALE)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return -fuse.ETIMEDOUT
+	}
+	if errors.Is(err, context.Canceled) {
+		return -fuse.EINTR
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if e, ok := s3Errnos[apiErr.ErrorCode()]; ok {
+			return -e
+		}
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		if e, ok := statusErrnos[respErr.HTTPStatusCode()]; ok {
+			return -e
+		}
+		return -fuse.EIO
+	}
+	/* broken connection, its errno means nothing for file */
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		if opErr.Timeout() {
+			return -fuse.ETIMEDOUT
+		}
+		return -fuse.EIO
+	}
+	/* local errors, e.g. full disk under temporary files */
+	var sysErr syscall.Errno
+	if errors.As(err, &sysErr) {
+		return -int(sysErr)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return -fuse.ETIMEDOUT
+	}
+	return -fuse.EIO
+}
@@ -0,0 +1,54 @@
+package ss3fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func TestErrno(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		errno int
+	}{
+		{nil, 0},
+		{fmt.Errorf("%w: key", ErrNotExist), -fuse.ENOENT},
+		{faultError("AccessDenied", 0), -fuse.EACCES},
+		{faultError("NoSuchBucket", 404), -fuse.ENODEV},
+		{faultError("SlowDown", 0), -fuse.EAGAIN},
+		{faultError("EntityTooLarge", 400), -fuse.EFBIG},
+		{faultError("PreconditionFailed", 412), -int(syscall.ESTALE)},
+		{faultError("QuotaExceeded", 403), -int(syscall.EDQUOT)},
+		/* HEAD responses have no error code */
+		{faultError("Forbidden", 403), -fuse.EACCES},
+		{faultError("InternalError", 0), -fuse.EIO},
+		{fmt.Errorf("operation error: %w", context.DeadlineExceeded), -fuse.ETIMEDOUT},
+		{resetError(), -fuse.EIO},
+		{&os.PathError{Op: "write", Path: "/tmp/x", Err: syscall.ENOSPC}, -fuse.ENOSPC},
+		{io.ErrUnexpectedEOF, -fuse.EIO},
+	} {
+		if errc := errno(tc.err); errc != tc.errno {
+			t.Errorf("Wrong errno of %v: %d, want %d\n", tc.err, errc, tc.errno)
+		}
+	}
+}
+
+func TestOpsReturnErrno(t *testing.T) {
+	cfg := &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"Put"}, Key: "denied", Error: "AccessDenied"},
+		{Ops: []string{"Head"}, Key: "slow", Error: "SlowDown"},
+	}}
+	fs := newFaultFs(t, cfg)
+	if errc := fs.Mknod("/denied", fuse.S_IFREG|0644, 0); errc != -fuse.EACCES {
+		t.Errorf("Failed create returned %d\n", errc)
+	}
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/slow", &stat, ^uint64(0)); errc != -fuse.EAGAIN {
+		t.Errorf("Throttled getattr returned %d\n", errc)
+	}
+}
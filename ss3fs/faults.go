@@ -0,0 +1,369 @@
+package ss3fs
+
+/* Fault injection for tests and debugging: FaultStore wraps any object store */
+/* and breaks its calls according to rules, failures look like real S3 ones */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+var (
+	ErrBadFaultConfig = errors.New("bad fault injection config")
+)
+
+/* Duration, that is written as "1.5s" in json config */
+type FaultDuration time.Duration
+
+func (d *FaultDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = FaultDuration(parsed)
+	return err
+}
+
+/* FaultRule breaks matching calls, all set effects are applied */
+type FaultRule struct {
+	/* store methods: Head, GetRange, Put, List, ..., all if empty */
+	Ops []string `json:"ops"`
+	/* path.Match pattern of object key, all keys if empty */
+	Key string `json:"key"`
+	/* chance to trigger, 0 means always */
+	Probability float64 `json:"probability"`
+	/* stop after this many triggers, 0 means never stop */
+	Count int `json:"count"`
+	/* delay before call */
+	Latency FaultDuration `json:"latency"`
+	/* S3 error code, e.g. SlowDown, InternalError, AccessDenied */
+	Error string `json:"error"`
+	/* HTTP status of error, usual one for the code if 0 */
+	Status int `json:"status"`
+	/* GetRange body ends with unexpected EOF after this many bytes */
+	Truncate int64 `json:"truncate"`
+	/* connection is reset, body is reset after Truncate bytes if set */
+	Reset     bool `json:"reset"`
+	triggered int
+}
+
+type FaultConfig struct {
+	/* seed of random source, runs with same seed inject same faults */
+	Seed int64 `json:"seed"`
+	/* created and deleted keys show up in listings only after this delay */
+	ListDelay FaultDuration `json:"list_delay"`
+	Rules     []*FaultRule  `json:"rules"`
+}
+
+func LoadFaultConfig(name string) (*FaultConfig, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var cfg FaultConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadFaultConfig, err)
+	}
+	return &cfg, nil
+}
+
+/* recent change of key, hidden from listings for ListDelay */
+type listChange struct {
+	at time.Time
+	/* object before change, nil if it didn't exist */
+	old *ObjectInfo
+}
+
+type FaultStore struct {
+	store   ObjectStore
+	cfg     *FaultConfig
+	lock    sync.Mutex
+	rnd     *rand.Rand
+	changes map[string]listChange
+	log     func(msg string, args ...any)
+}
+
+func NewFaultStore(store ObjectStore, cfg *FaultConfig) *FaultStore {
+	return &FaultStore{
+		store:   store,
+		cfg:     cfg,
+		rnd:     rand.New(rand.NewSource(cfg.Seed)),
+		changes: make(map[string]listChange),
+		log:     func(string, ...any) {},
+	}
+}
+
+/* replace rules while store is in use */
+func (st *FaultStore) SetRules(rules []*FaultRule) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.cfg.Rules = rules
+}
+
+/* status S3 uses for error code */
+var faultStatus = map[string]int{
+	"AccessDenied":       http.StatusForbidden,
+	"NoSuchBucket":       http.StatusNotFound,
+	"NoSuchKey":          http.StatusNotFound,
+	"EntityTooLarge":     http.StatusBadRequest,
+	"PreconditionFailed": http.StatusPreconditionFailed,
+	"RequestTimeout":     http.StatusBadRequest,
+	"SlowDown":           http.StatusServiceUnavailable,
+	"ServiceUnavailable": http.StatusServiceUnavailable,
+}
+
+/* S3 error with HTTP status, as SDK returns it */
+func faultError(code string, status int) error {
+	if status == 0 {
+		status = faultStatus[code]
+	}
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	return &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+			Err:      &smithy.GenericAPIError{Code: code, Message: "injected fault"},
+		},
+		RequestID: "injected-fault",
+	}
+}
+
+func resetError() error {
+	return &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+}
+
+/* find triggered rule and wait for its latency */
+func (st *FaultStore) inject(ctx context.Context, op string, key string) (*FaultRule, error) {
+	st.lock.Lock()
+	var fired *FaultRule
+	for i, rule := range st.cfg.Rules {
+		if len(rule.Ops) != 0 && !contains(rule.Ops, op) {
+			continue
+		}
+		if rule.Key != "" {
+			if ok, _ := path.Match(rule.Key, key); !ok {
+				continue
+			}
+		}
+		if rule.Count != 0 && rule.triggered >= rule.Count {
+			continue
+		}
+		if rule.Probability != 0 && st.rnd.Float64() >= rule.Probability {
+			continue
+		}
+		rule.triggered++
+		fired = rule
+		st.log("fault injected", "rule", i, "s3_op", op, "key", key)
+		break
+	}
+	st.lock.Unlock()
+	if fired == nil {
+		return nil, nil
+	}
+	if fired.Latency != 0 {
+		select {
+		case <-time.After(time.Duration(fired.Latency)):
+		case <-ctx.Done():
+			return fired, ctx.Err()
+		}
+	}
+	switch {
+	case fired.Error != "":
+		return fired, faultError(fired.Error, fired.Status)
+	case fired.Reset && fired.Truncate == 0:
+		return fired, resetError()
+	}
+	return fired, nil
+}
+
+func contains(list []string, item string) bool {
+	for _, it := range list {
+		if it == item {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *FaultStore) BucketExists(ctx context.Context) (bool, error) {
+	if _, err := st.inject(ctx, "BucketExists", ""); err != nil {
+		return false, err
+	}
+	return st.store.BucketExists(ctx)
+}
+
+func (st *FaultStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	if _, err := st.inject(ctx, "Head", key); err != nil {
+		return ObjectInfo{}, err
+	}
+	return st.store.Head(ctx, key)
+}
+
+/* body, that breaks after some bytes */
+type faultBody struct {
+	io.ReadCloser
+	left  int64
+	reset bool
+}
+
+func (body *faultBody) Read(buff []byte) (int, error) {
+	if body.left <= 0 {
+		if body.reset {
+			return 0, resetError()
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(buff)) > body.left {
+		buff = buff[:body.left]
+	}
+	n, err := body.ReadCloser.Read(buff)
+	body.left -= int64(n)
+	return n, err
+}
+
+func (st *FaultStore) GetRange(ctx context.Context, key string, ofst int64, length int64, etag string) (io.ReadCloser, error) {
+	rule, err := st.inject(ctx, "GetRange", key)
+	if err != nil {
+		return nil, err
+	}
+	body, err := st.store.GetRange(ctx, key, ofst, length, etag)
+	if err != nil || rule == nil || rule.Truncate == 0 {
+		return body, err
+	}
+	return &faultBody{ReadCloser: body, left: rule.Truncate, reset: rule.Reset}, nil
+}
+
+/* remember state of key before change, for delayed listing */
+func (st *FaultStore) changing(ctx context.Context, key string) {
+	if st.cfg.ListDelay == 0 {
+		return
+	}
+	var old *ObjectInfo
+	if info, err := st.store.Head(ctx, key); err == nil {
+		old = &info
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if change, ok := st.changes[key]; ok {
+		/* listing still shows state before the first change */
+		old = change.old
+	}
+	st.changes[key] = listChange{at: time.Now(), old: old}
+}
+
+func (st *FaultStore) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, meta map[string]string, cond Condition) (string, error) {
+	if _, err := st.inject(ctx, "Put", key); err != nil {
+		return "", err
+	}
+	st.changing(ctx, key)
+	return st.store.Put(ctx, key, body, size, meta, cond)
+}
+
+func (st *FaultStore) CreateMultipart(ctx context.Context, key string, meta map[string]string) (string, error) {
+	if _, err := st.inject(ctx, "CreateMultipart", key); err != nil {
+		return "", err
+	}
+	return st.store.CreateMultipart(ctx, key, meta)
+}
+
+func (st *FaultStore) UploadPart(ctx context.Context, key string, uploadID string, number int32, body io.ReadSeeker, size int64) (string, error) {
+	if _, err := st.inject(ctx, "UploadPart", key); err != nil {
+		return "", err
+	}
+	return st.store.UploadPart(ctx, key, uploadID, number, body, size)
+}
+
+func (st *FaultStore) CompleteMultipart(ctx context.Context, key string, uploadID string, parts []CompletedPart, cond Condition) (string, error) {
+	if _, err := st.inject(ctx, "CompleteMultipart", key); err != nil {
+		return "", err
+	}
+	st.changing(ctx, key)
+	return st.store.CompleteMultipart(ctx, key, uploadID, parts, cond)
+}
+
+func (st *FaultStore) AbortMultipart(ctx context.Context, key string, uploadID string) error {
+	if _, err := st.inject(ctx, "AbortMultipart", key); err != nil {
+		return err
+	}
+	return st.store.AbortMultipart(ctx, key, uploadID)
+}
+
+func (st *FaultStore) Copy(ctx context.Context, src string, dst string) error {
+	if _, err := st.inject(ctx, "Copy", dst); err != nil {
+		return err
+	}
+	st.changing(ctx, dst)
+	return st.store.Copy(ctx, src, dst)
+}
+
+func (st *FaultStore) Delete(ctx context.Context, key string) error {
+	if _, err := st.inject(ctx, "Delete", key); err != nil {
+		return err
+	}
+	st.changing(ctx, key)
+	return st.store.Delete(ctx, key)
+}
+
+/* listing shows recently changed keys as they were before the change */
+func (st *FaultStore) List(ctx context.Context, prefix string, delimiter string, token string) (ListResult, error) {
+	if _, err := st.inject(ctx, "List", prefix); err != nil {
+		return ListResult{}, err
+	}
+	list, err := st.store.List(ctx, prefix, delimiter, token)
+	if err != nil || st.cfg.ListDelay == 0 {
+		return list, err
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	stale := make(map[string]*ObjectInfo)
+	for key, change := range st.changes {
+		if time.Since(change.at) >= time.Duration(st.cfg.ListDelay) {
+			delete(st.changes, key)
+			continue
+		}
+		stale[key] = change.old
+	}
+	objects := list.Objects[:0]
+	for _, object := range list.Objects {
+		old, ok := stale[object.Key]
+		if !ok {
+			objects = append(objects, object)
+			continue
+		}
+		delete(stale, object.Key)
+		if old != nil {
+			objects = append(objects, *old)
+		}
+	}
+	/* recently deleted objects are still listed */
+	for key, old := range stale {
+		if old == nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter == "" || !strings.Contains(key[len(prefix):], delimiter) {
+			objects = append(objects, *old)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	list.Objects = objects
+	return list, nil
+}
@@ -0,0 +1,95 @@
+package ss3fs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func newFaultFs(t *testing.T, cfg *FaultConfig) *Ss3fs {
+	opts := DefaultOptions()
+	opts.Faults = cfg
+	/* injected faults are seen as they are, by the call itself */
+	opts.Retry.MaxAttempts = 1
+	opts.UploadWorkers = 0
+	fs, err := NewSs3fsWithStore(NewMemStore(), opts)
+	if err != nil {
+		t.Fatalf("Can't create file system, error: %v\n", err)
+	}
+	return fs
+}
+
+func TestFaultRules(t *testing.T) {
+	cfg := &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"Put"}, Key: "slow*", Error: "SlowDown", Count: 1},
+		{Ops: []string{"GetRange"}, Key: "cut", Truncate: 3},
+	}}
+	fs := newFaultFs(t, cfg)
+	st := fs.store
+	ctx := context.Background()
+
+	_, err := st.Put(ctx, "slow1", emptyBody(), 0, nil, Condition{})
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "SlowDown" {
+		t.Errorf("Wrong injected error %v\n", err)
+	}
+	/* rule is used up */
+	if _, err := st.Put(ctx, "slow1", emptyBody(), 0, nil, Condition{}); err != nil {
+		t.Errorf("Fault injected twice, error: %v\n", err)
+	}
+
+	fs.Mknod("/cut", fuse.S_IFREG|0644, 0)
+	errc, fh := fs.Open("/cut", fuse.O_RDWR)
+	if errc != 0 {
+		t.Errorf("Can't open file, errc: %d\n", errc)
+		return
+	}
+	/* write downloads nothing from empty object, release uploads it */
+	fs.Write("/cut", []byte("0123456789"), 0, fh)
+	fs.Release("/cut", fh)
+	buff := make([]byte, 10)
+	if n := fs.Read("/cut", buff, 0, fh); n != -fuse.EIO {
+		t.Errorf("Truncated body was read as %d bytes\n", n)
+	}
+}
+
+func TestFaultLatency(t *testing.T) {
+	cfg := &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"Head"}, Latency: FaultDuration(time.Hour)},
+	}}
+	fs := newFaultFs(t, cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := fs.store.Head(ctx, "file"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Delayed call wasn't cancelled, error: %v\n", err)
+	}
+}
+
+func TestFaultListDelay(t *testing.T) {
+	cfg := &FaultConfig{ListDelay: FaultDuration(50 * time.Millisecond)}
+	fs := newFaultFs(t, cfg)
+	fs.Mknod("/file", fuse.S_IFREG|0644, 0)
+	list := func() int {
+		count := 0
+		fs.Readdir("/", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+			count++
+			return true
+		}, 0, 0)
+		return count - 2
+	}
+	if n := list(); n != 0 {
+		t.Errorf("New file listed before delay, %d entries\n", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if n := list(); n != 1 {
+		t.Errorf("New file isn't listed after delay, %d entries\n", n)
+	}
+	fs.Unlink("/file")
+	if n := list(); n != 1 {
+		t.Errorf("Deleted file isn't listed before delay, %d entries\n", n)
+	}
+}
@@ -0,0 +1,224 @@
+package ss3fs
+
+/* Journal of staged files, that aren't uploaded yet */
+/* Every dirty staged file has a record with its key and the progress of its */
+/* multipart upload, so after crash its data is uploaded on the next start. */
+/* Records are replaced atomically, data files are synced before the first record. */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	journalDataSuffix   = ".data"
+	journalRecordSuffix = ".json"
+	journalTmpSuffix    = ".tmp"
+)
+
+/* journal in directory, nil if staged data isn't kept over restarts */
+type journal struct {
+	dir string
+}
+
+type journalRecord struct {
+	Key string `json:"key"`
+	/* name of staged data file in journal dir */
+	Data string `json:"data"`
+	/* ETag of object the changes are based on, upload fails if it changed */
+	Base string `json:"base,omitempty"`
+	/* multipart upload in progress and its uploaded parts */
+	UploadID string          `json:"upload_id,omitempty"`
+	Parts    []CompletedPart `json:"parts,omitempty"`
+}
+
+func openJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &journal{dir: dir}, nil
+}
+
+/* new file for staged data, temporary one without journal */
+func (j *journal) dataFile() (*os.File, error) {
+	if j == nil {
+		return os.CreateTemp("", "ss3fs-")
+	}
+	return os.CreateTemp(j.dir, "*"+journalDataSuffix)
+}
+
+func (j *journal) recordPath(rec *journalRecord) string {
+	return filepath.Join(j.dir, strings.TrimSuffix(rec.Data, journalDataSuffix)+journalRecordSuffix)
+}
+
+/* write record durably, old version is replaced at once */
+func (j *journal) save(rec *journalRecord) error {
+	if j == nil {
+		return nil
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	path := j.recordPath(rec)
+	file, err := os.Create(path + journalTmpSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	/* rename itself must survive power loss */
+	dir, err := os.Open(j.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (j *journal) remove(rec *journalRecord) {
+	if j == nil {
+		return
+	}
+	os.Remove(j.recordPath(rec))
+}
+
+/* records left by previous mount, data files without record are removed */
+func (j *journal) load() ([]*journalRecord, error) {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	var records []*journalRecord
+	used := make(map[string]bool)
+	for _, entry := range entries {
+		path := filepath.Join(j.dir, entry.Name())
+		switch {
+		case strings.HasSuffix(entry.Name(), journalTmpSuffix):
+			/* record was being replaced, the previous one is still there */
+			os.Remove(path)
+		case strings.HasSuffix(entry.Name(), journalRecordSuffix):
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			var rec journalRecord
+			if err := json.Unmarshal(data, &rec); err != nil || rec.Key == "" || rec.Data == "" {
+				/* can't be a complete record, save is atomic */
+				os.Remove(path)
+				continue
+			}
+			records = append(records, &rec)
+			used[rec.Data] = true
+		}
+	}
+	for _, entry := range entries {
+		/* nothing was written into file yet, when its record is missing */
+		if strings.HasSuffix(entry.Name(), journalDataSuffix) && !used[entry.Name()] {
+			os.Remove(filepath.Join(j.dir, entry.Name()))
+		}
+	}
+	return records, nil
+}
+
+/* outcome of recovery of file staged before restart */
+type RecoveredFile struct {
+	Key string
+	/* recovered if uploaded now, abandoned if staged data is lost, */
+	/* failed if upload failed again and file is kept for next start, */
+	/* conflict if object was changed by others and changes are dropped */
+	Status string
+	Err    error
+}
+
+const (
+	RecoveryRecovered = "recovered"
+	RecoveryAbandoned = "abandoned"
+	RecoveryFailed    = "failed"
+	RecoveryConflict  = "conflict"
+)
+
+/* files found in journal on start */
+func (fs *Ss3fs) Recovered() []RecoveredFile {
+	return fs.recovered
+}
+
+/* upload staged files left by previous mount */
+func (fs *Ss3fs) recoverJournal() error {
+	records, err := fs.journal.load()
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		result := fs.recoverRecord(rec)
+		fs.recovered = append(fs.recovered, result)
+		switch result.Status {
+		case RecoveryRecovered:
+			fs.log.Warn("staged file recovered", "key", rec.Key, "resumed", rec.UploadID != "")
+		case RecoveryAbandoned:
+			fs.log.Error("staged file abandoned", "key", rec.Key, "err", result.Err)
+		case RecoveryConflict:
+			fs.log.Error("staged file conflicts with changes of others", "key", rec.Key, "err", result.Err)
+		default:
+			fs.log.Error("staged file wasn't recovered, will retry on next start", "key", rec.Key, "err", result.Err)
+		}
+	}
+	return nil
+}
+
+func (fs *Ss3fs) recoverRecord(rec *journalRecord) RecoveredFile {
+	result := RecoveredFile{Key: rec.Key, Status: RecoveryFailed}
+	path := filepath.Join(fs.journal.dir, rec.Data)
+	file, err := os.Open(path)
+	if err != nil {
+		fs.journal.remove(rec)
+		result.Status, result.Err = RecoveryAbandoned, err
+		return result
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	ctx, cancel := context.WithCancel(fs.ctx)
+	if fs.opts.DataTimeout > 0 {
+		ctx, cancel = context.WithTimeout(fs.ctx, fs.opts.DataTimeout)
+	}
+	defer cancel()
+	/* nobody to report conflict to, it is saved as sibling */
+	_, sibling, err := fs.uploadResolved(ctx, rec, file, info.Size(), false)
+	if errors.Is(err, ErrNoSuchUpload) {
+		/* upload expired or was completed right before crash */
+		rec.UploadID, rec.Parts = "", nil
+		_, sibling, err = fs.uploadResolved(ctx, rec, file, info.Size(), false)
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	fs.journal.remove(rec)
+	os.Remove(path)
+	result.Status = RecoveryRecovered
+	if sibling != "" {
+		result.Status, result.Err = RecoveryConflict, fmt.Errorf("%w, changes are saved as %s", ErrConflict, sibling)
+	}
+	return result
+}
@@ -0,0 +1,162 @@
+package ss3fs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func storeContent(t *testing.T, st ObjectStore, key string) []byte {
+	ctx := context.Background()
+	info, err := st.Head(ctx, key)
+	if err != nil {
+		t.Errorf("Can't head %s, error: %v\n", key, err)
+		return nil
+	}
+	if info.Size == 0 {
+		return []byte{}
+	}
+	body, err := st.GetRange(ctx, key, 0, info.Size, "")
+	if err != nil {
+		t.Errorf("Can't get %s, error: %v\n", key, err)
+		return nil
+	}
+	defer body.Close()
+	data, _ := io.ReadAll(body)
+	return data
+}
+
+func TestStagedWrites(t *testing.T) {
+	st := NewMemStore()
+	fs, err := NewSs3fsWithStore(st, DefaultOptions())
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	fs.Mknod("/f", fuse.S_IFREG|0644, 0)
+	_, fh := fs.Open("/f", fuse.O_RDWR)
+	fs.Write("/f", []byte("hello"), 0, fh)
+	if data := storeContent(t, st, "f"); len(data) != 0 {
+		t.Errorf("Write was uploaded before flush %q\n", data)
+	}
+	var stat fuse.Stat_t
+	if fs.Getattr("/f", &stat, fh); stat.Size != 5 {
+		t.Errorf("Staged size is %d\n", stat.Size)
+	}
+	buff := make([]byte, 10)
+	if n := fs.Read("/f", buff, 0, fh); n != 5 || string(buff[:n]) != "hello" {
+		t.Errorf("Read of staged file returned %d %q\n", n, buff[:max(n, 0)])
+	}
+	if errc := fs.Flush("/f", fh); errc != 0 {
+		t.Errorf("Flush failed with %d\n", errc)
+	}
+	fs.Sync(context.Background())
+	if data := storeContent(t, st, "f"); string(data) != "hello" {
+		t.Errorf("Flush uploaded %q\n", data)
+	}
+	fs.Write("/f", []byte(" world"), 5, fh)
+	if errc := fs.Release("/f", fh); errc != 0 {
+		t.Errorf("Release failed with %d\n", errc)
+	}
+	fs.Sync(context.Background())
+	if data := storeContent(t, st, "f"); string(data) != "hello world" {
+		t.Errorf("Release uploaded %q\n", data)
+	}
+	if len(fs.staged) != 0 {
+		t.Errorf("Staged files left after release\n")
+	}
+}
+
+func TestJournalRecovery(t *testing.T) {
+	mem := NewMemStore()
+	opts := DefaultOptions()
+	opts.Retry.MaxAttempts = 1
+	/* failed upload is seen by flush */
+	opts.UploadWorkers = 0
+	opts.CacheDir = t.TempDir()
+	faults := NewFaultStore(mem, &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"CompleteMultipart"}, Error: "InternalError"},
+	}})
+	fs, err := NewSs3fsWithStore(faults, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	for _, path := range []string{"/small", "/big", "/lost"} {
+		fs.Mknod(path, fuse.S_IFREG|0644, 0)
+		fs.Open(path, fuse.O_RDWR)
+	}
+	fs.Write("/small", []byte("recovered data"), 0, 0)
+	big := bytes.Repeat([]byte("x"), int(partSize)+10)
+	fs.Write("/big", big, 0, 0)
+	/* parts are uploaded, completion fails */
+	if errc := fs.Flush("/big", 0); errc == 0 {
+		t.Errorf("Flush of big file didn't fail\n")
+	}
+	fs.Write("/lost", []byte("lost data"), 0, 0)
+	os.Remove(fs.staged["lost"].file.Name())
+	/* crash, nothing is released */
+	fs.Destroy()
+
+	/* parts must not be uploaded again */
+	faults = NewFaultStore(mem, &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"UploadPart"}, Error: "InternalError"},
+	}})
+	fs, err = NewSs3fsWithStore(faults, opts)
+	if err != nil {
+		t.Errorf("Can't create file system after crash, error: %v\n", err)
+		return
+	}
+	status := make(map[string]string)
+	for _, rec := range fs.Recovered() {
+		status[rec.Key] = rec.Status
+	}
+	if status["small"] != RecoveryRecovered || status["big"] != RecoveryRecovered || status["lost"] != RecoveryAbandoned {
+		t.Errorf("Wrong recovery results %v\n", fs.Recovered())
+	}
+	if data := storeContent(t, mem, "small"); string(data) != "recovered data" {
+		t.Errorf("Recovered content is %q\n", data)
+	}
+	if data := storeContent(t, mem, "big"); !bytes.Equal(data, big) {
+		t.Errorf("Recovered big file has %d bytes\n", len(data))
+	}
+	if data := storeContent(t, mem, "lost"); len(data) != 0 {
+		t.Errorf("Lost file has content %q\n", data)
+	}
+	/* journal is clean now */
+	fs, _ = NewSs3fsWithStore(mem, opts)
+	if len(fs.Recovered()) != 0 {
+		t.Errorf("Journal wasn't cleaned %v\n", fs.Recovered())
+	}
+}
+
+/* failed unlink keeps staged changes of the file, which still exists */
+func TestUnlinkFailureKeepsChanges(t *testing.T) {
+	mem := NewMemStore()
+	putString(mem, "f", "")
+	cfg := &FaultConfig{Rules: []*FaultRule{{Ops: []string{"Delete"}, Error: "AccessDenied", Count: 1}}}
+	opts := DefaultOptions()
+	opts.Faults = cfg
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	_, fh := fs.Open("/f", fuse.O_RDWR)
+	fs.Write("/f", []byte("kept"), 0, fh)
+	if errc := fs.Unlink("/f"); errc != -fuse.EACCES {
+		t.Errorf("Failed unlink returned %d\n", errc)
+	}
+	if errc := fs.Release("/f", fh); errc != 0 {
+		t.Errorf("Release failed with %d\n", errc)
+	}
+	fs.Sync(context.Background())
+	if data := storeContent(t, mem, "f"); string(data) != "kept" {
+		t.Errorf("Changes were dropped by failed unlink %q\n", data)
+	}
+}
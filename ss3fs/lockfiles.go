@@ -0,0 +1,270 @@
+package ss3fs
+
+/* Lock files: with a lock lease set, *.lock files are advisory locks shared by */
+/* all hosts. Exclusive creation decides the owner, lease expiry is kept in the */
+/* object metadata and renewed while the owner mounts the bucket and the file */
+/* exists. Removing the file releases the lock, locks with expired lease, e.g. */
+/* of a crashed host, look removed and are taken over by the next create. Hosts */
+/* need synchronized clocks. Renewal checks the owner by Head before writing with */
+/* If-Match, a lock taken over between both requests may still be renewed once. */
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lockSuffix = ".lock"
+	/* user metadata keys of lock files */
+	leaseExpiresMeta = "ss3fs-lease-expires"
+	leaseOwnerMeta   = "ss3fs-lease-owner"
+)
+
+/* lock files held by this host */
+type lockLeases struct {
+	lock sync.Mutex
+	/* ETag of held lock file by name */
+	held map[string]string
+	/* host and process, stored with the lease */
+	owner string
+}
+
+func newLockLeases() *lockLeases {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &lockLeases{held: make(map[string]string), owner: fmt.Sprintf("%s:%d", host, os.Getpid())}
+}
+
+func (ll *lockLeases) hold(name string, etag string) {
+	if ll == nil {
+		return
+	}
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	ll.held[name] = etag
+}
+
+/* ETag of held lock file */
+func (ll *lockLeases) etag(name string) (string, bool) {
+	if ll == nil {
+		return "", false
+	}
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	etag, ok := ll.held[name]
+	return etag, ok
+}
+
+/* new ETag of lock file, if it is held */
+func (ll *lockLeases) update(name string, etag string) {
+	if ll == nil {
+		return
+	}
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	if _, ok := ll.held[name]; ok {
+		ll.held[name] = etag
+	}
+}
+
+/* lock file isn't held anymore, returns true if it was */
+func (ll *lockLeases) release(name string) bool {
+	if ll == nil {
+		return false
+	}
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	_, ok := ll.held[name]
+	delete(ll.held, name)
+	return ok
+}
+
+func (ll *lockLeases) names() []string {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	names := make([]string, 0, len(ll.held))
+	for name := range ll.held {
+		names = append(names, name)
+	}
+	return names
+}
+
+/* true if name is a lock file by convention */
+func (fs *Ss3fs) lockFile(name string) bool {
+	return fs.leases != nil && strings.HasSuffix(name, lockSuffix)
+}
+
+/* metadata of lock file with lease starting now */
+func (fs *Ss3fs) newLease() map[string]string {
+	return map[string]string{
+		leaseExpiresMeta: time.Now().Add(fs.opts.LockLease).UTC().Format(time.RFC3339Nano),
+		leaseOwnerMeta:   fs.leases.owner,
+	}
+}
+
+/* lease metadata for upload of name, nil unless it is a held lock file */
+func (fs *Ss3fs) heldLease(name string) map[string]string {
+	if _, ok := fs.leases.etag(name); !ok {
+		return nil
+	}
+	return fs.newLease()
+}
+
+/* lock files without lease, e.g. of hosts without lock lease, */
+/* are leased since their last change */
+func (fs *Ss3fs) leaseExpired(info ObjectInfo) bool {
+	expires, err := time.Parse(time.RFC3339Nano, info.Metadata[leaseExpiresMeta])
+	if err != nil {
+		expires = info.LastModified.Add(fs.opts.LockLease)
+	}
+	return time.Now().After(expires)
+}
+
+/* lock files with expired lease of others look removed, so exclusive create */
+/* gets past the kernel lookup and takes them over, they are never cached */
+func (fs *Ss3fs) lookupLock(ctx context.Context, name string, attr *Attrs) (bool, error) {
+	info, exists, err := fs.headObject(ctx, name)
+	if !exists || err != nil {
+		return false, err
+	}
+	if _, held := fs.leases.etag(name); !held && fs.leaseExpired(info) {
+		return false, nil
+	}
+	if attr != nil {
+		attr.setInfo(info)
+	}
+	return true, nil
+}
+
+/* create lock file or take over lock with expired lease, */
+/* ErrPreconditionFailed if others hold it, must be called under write lock of name */
+func (fs *Ss3fs) acquireLock(op *operation, name string) error {
+	etag, err := fs.store.Put(op.ctx, name, emptyBody(), 0, fs.newLease(), Condition{IfNoneMatch: true})
+	if errors.Is(err, ErrPreconditionFailed) {
+		etag, err = fs.reclaimLock(op, name)
+	}
+	if err != nil {
+		return err
+	}
+	fs.leases.hold(name, etag)
+	return nil
+}
+
+func (fs *Ss3fs) reclaimLock(op *operation, name string) (string, error) {
+	info, err := fs.store.Head(op.ctx, name)
+	if err != nil {
+		if errors.Is(err, ErrNotExist) {
+			/* removed meanwhile, others may create it first again */
+			err = fmt.Errorf("%w: lock %s was released, try again", ErrPreconditionFailed, name)
+		}
+		return "", err
+	}
+	owner := info.Metadata[leaseOwnerMeta]
+	if !fs.leaseExpired(info) {
+		return "", fmt.Errorf("%w: lock %s is held by %q", ErrPreconditionFailed, name, owner)
+	}
+	/* lock content of the previous owner is replaced */
+	etag, err := fs.store.Put(op.ctx, name, emptyBody(), 0, fs.newLease(), Condition{IfMatch: info.ETag})
+	if errors.Is(err, ErrNotExist) {
+		err = fmt.Errorf("%w: lock %s was released, try again", ErrPreconditionFailed, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	op.log.Warn("lock with expired lease is taken over", "owner", owner, "expires", info.Metadata[leaseExpiresMeta])
+	return etag, nil
+}
+
+/* renew leases of held lock files until unmount */
+func (fs *Ss3fs) startLeases() {
+	go func() {
+		ticker := time.NewTicker(fs.opts.LockLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-fs.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, name := range fs.leases.names() {
+				if err := fs.renewLock(name); err != nil && fs.ctx.Err() == nil {
+					fs.log.Warn("renewal of lock lease failed", "key", name, "err", err)
+				}
+			}
+		}
+	}()
+}
+
+/* write lock file again with new lease, lock taken over by others is dropped */
+func (fs *Ss3fs) renewLock(name string) error {
+	if !fs.beginUpdate() {
+		/* lease may expire while offline, it is lost then */
+		return nil
+	}
+	defer fs.endUpdate()
+	defer fs.paths.wlock(name)()
+	ctx, cancel := context.WithCancel(fs.ctx)
+	if fs.opts.MetaTimeout > 0 {
+		ctx, cancel = context.WithTimeout(fs.ctx, fs.opts.MetaTimeout)
+	}
+	defer cancel()
+	held, ok := fs.leases.etag(name)
+	if !ok {
+		/* removed meanwhile */
+		return nil
+	}
+	sf := fs.findStaged(name)
+	if sf != nil && sf.dirty {
+		/* upload of changes carries new lease */
+		return fs.flushStaged(ctx, sf, false)
+	}
+	info, err := fs.store.Head(ctx, name)
+	if err == nil && (info.ETag != held || info.Metadata[leaseOwnerMeta] != fs.leases.owner) {
+		err = fmt.Errorf("%w: lock is owned by %q", ErrPreconditionFailed, info.Metadata[leaseOwnerMeta])
+	}
+	etag := ""
+	if err == nil {
+		etag, err = fs.rewriteLock(ctx, name, info.Size, held)
+	}
+	if errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrNotExist) {
+		fs.leases.release(name)
+		fs.log.Error("lock file was taken over or removed by others", "key", name, "err", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fs.leases.hold(name, etag)
+	if sf != nil {
+		sf.base = etag
+	}
+	fs.rebase(name, etag, info.Size)
+	fs.meta.changed(name)
+	return nil
+}
+
+/* put content of lock file back with new lease, unless it changed */
+func (fs *Ss3fs) rewriteLock(ctx context.Context, name string, size int64, held string) (string, error) {
+	var data []byte
+	if size > 0 {
+		body, err := fs.store.GetRange(ctx, name, 0, size, held)
+		if err != nil {
+			return "", err
+		}
+		data, err = io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return fs.store.Put(ctx, name, bytes.NewReader(data), int64(len(data)), fs.newLease(), Condition{IfMatch: held})
+}
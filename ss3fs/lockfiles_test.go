@@ -0,0 +1,164 @@
+package ss3fs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const testLease = 300 * time.Millisecond
+
+/* two mounts of one bucket with lock files */
+func newLockHosts(t *testing.T, mem *MemStore) (*Ss3fs, *Ss3fs) {
+	var hosts [2]*Ss3fs
+	for i := range hosts {
+		opts := DefaultOptions()
+		opts.LockLease = testLease
+		fs, err := NewSs3fsWithStore(mem, opts)
+		if err != nil {
+			t.Fatalf("Can't create file system, error: %v\n", err)
+		}
+		t.Cleanup(fs.Destroy)
+		hosts[i] = fs
+	}
+	return hosts[0], hosts[1]
+}
+
+/* exclusive create like the kernel does it, after lookup of path */
+func lockExcl(fs *Ss3fs, path string) int {
+	var stat fuse.Stat_t
+	if errc := fs.Getattr(path, &stat, ^uint64(0)); errc != -fuse.ENOENT {
+		if errc == 0 {
+			return -fuse.EEXIST
+		}
+		return errc
+	}
+	errc, fh := fs.Create(path, fuse.O_CREAT|fuse.O_EXCL|fuse.O_RDWR, 0644)
+	if errc == 0 {
+		fs.Release(path, fh)
+	}
+	return errc
+}
+
+func TestLockFileRenewal(t *testing.T) {
+	mem := NewMemStore()
+	a, b := newLockHosts(t, mem)
+	errc, fh := a.Create("/job.lock", fuse.O_CREAT|fuse.O_EXCL|fuse.O_RDWR, 0644)
+	if errc != 0 {
+		t.Errorf("Create of lock failed with %d\n", errc)
+		return
+	}
+	a.Write("/job.lock", []byte("pid 1"), 0, fh)
+	a.Release("/job.lock", fh)
+	a.Sync(context.Background())
+	/* lease is renewed, it never expires while a has the lock */
+	time.Sleep(3 * testLease)
+	if errc := lockExcl(b, "/job.lock"); errc != -fuse.EEXIST {
+		t.Errorf("Lock held by others was taken with %d\n", errc)
+	}
+	info, err := mem.Head(context.Background(), "job.lock")
+	if err != nil || info.Metadata[leaseOwnerMeta] != a.leases.owner {
+		t.Errorf("Wrong lock metadata %v, error: %v\n", info.Metadata, err)
+	}
+	if data := storeContent(t, mem, "job.lock"); string(data) != "pid 1" {
+		t.Errorf("Renewal changed lock content %q\n", data)
+	}
+	/* removal releases lock */
+	if errc := a.Unlink("/job.lock"); errc != 0 {
+		t.Errorf("Unlink of lock failed with %d\n", errc)
+		return
+	}
+	if len(a.leases.names()) != 0 {
+		t.Errorf("Removed lock is still held %v\n", a.leases.names())
+	}
+	if errc := lockExcl(b, "/job.lock"); errc != 0 {
+		t.Errorf("Released lock wasn't taken, errc: %d\n", errc)
+	}
+}
+
+func TestLockFileStale(t *testing.T) {
+	mem := NewMemStore()
+	a, b := newLockHosts(t, mem)
+	/* lock of crashed host */
+	expired := map[string]string{
+		leaseExpiresMeta: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano),
+		leaseOwnerMeta:   "crashed:1",
+	}
+	mem.Put(context.Background(), "crashed.lock", emptyBody(), 0, expired, Condition{})
+	if errc := lockExcl(a, "/crashed.lock"); errc != 0 {
+		t.Errorf("Stale lock wasn't taken over, errc: %d\n", errc)
+		return
+	}
+	if errc := lockExcl(b, "/crashed.lock"); errc != -fuse.EEXIST {
+		t.Errorf("Lock taken over by a was taken again with %d\n", errc)
+	}
+	/* created by others between lookup and create */
+	if errc, _ := b.Create("/crashed.lock", fuse.O_CREAT|fuse.O_EXCL|fuse.O_RDWR, 0644); errc != -fuse.EEXIST {
+		t.Errorf("Create of lock held by a returned %d\n", errc)
+	}
+
+	/* lock files without lease are leased since their last change */
+	putString(mem, "plain.lock", "pid 2")
+	if errc := lockExcl(a, "/plain.lock"); errc != -fuse.EEXIST {
+		t.Errorf("Fresh lock without lease was taken with %d\n", errc)
+	}
+	time.Sleep(2 * testLease)
+	var stat fuse.Stat_t
+	if errc := b.Getattr("/plain.lock", &stat, ^uint64(0)); errc != -fuse.ENOENT {
+		t.Errorf("Stale lock doesn't look removed, errc: %d\n", errc)
+	}
+	if errc := lockExcl(a, "/plain.lock"); errc != 0 {
+		t.Errorf("Old lock without lease wasn't taken over, errc: %d\n", errc)
+	}
+	if data := storeContent(t, mem, "plain.lock"); len(data) != 0 {
+		t.Errorf("Content of previous owner was kept %q\n", data)
+	}
+
+	/* other files aren't locks */
+	putString(mem, "plain", "data")
+	time.Sleep(2 * testLease)
+	if errc := lockExcl(a, "/plain"); errc != -fuse.EEXIST {
+		t.Errorf("Exclusive create of plain file returned %d\n", errc)
+	}
+}
+
+func TestLockFileLost(t *testing.T) {
+	mem := NewMemStore()
+	a, _ := newLockHosts(t, mem)
+	if errc := lockExcl(a, "/lost.lock"); errc != 0 {
+		t.Errorf("Create of lock failed with %d\n", errc)
+		return
+	}
+	/* others took it over, e.g. while a was offline */
+	taken := map[string]string{
+		leaseExpiresMeta: time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano),
+		leaseOwnerMeta:   "other:1",
+	}
+	mem.Put(context.Background(), "lost.lock", emptyBody(), 0, taken, Condition{})
+	if err := a.renewLock("lost.lock"); err != nil {
+		t.Errorf("Renewal failed, error: %v\n", err)
+	}
+	if _, ok := a.leases.etag("lost.lock"); ok {
+		t.Errorf("Lock taken over by others is still held\n")
+	}
+	info, _ := mem.Head(context.Background(), "lost.lock")
+	if info.Metadata[leaseOwnerMeta] != "other:1" {
+		t.Errorf("Lease of others was overwritten %v\n", info.Metadata)
+	}
+}
+
+func TestS3ServerMetadata(t *testing.T) {
+	fs, _ := newS3TestFs(t)
+	ctx := context.Background()
+	meta := map[string]string{leaseOwnerMeta: "host:1"}
+	if _, err := fs.store.Put(ctx, "meta", emptyBody(), 0, meta, Condition{}); err != nil {
+		t.Errorf("Can't put object, error: %v\n", err)
+		return
+	}
+	info, err := fs.store.Head(ctx, "meta")
+	if err != nil || info.Metadata[leaseOwnerMeta] != "host:1" {
+		t.Errorf("Wrong metadata %v, error: %v\n", info.Metadata, err)
+	}
+}
@@ -0,0 +1,84 @@
+package ss3fs
+
+/* Per-path locks: operations on one object are ordered, */
+/* operations on different objects run in parallel */
+
+import (
+	"sort"
+	"sync"
+)
+
+type pathLock struct {
+	sync.RWMutex
+	/* operations holding or waiting for lock, entry is dropped at zero */
+	refs int
+}
+
+type pathLocks struct {
+	lock  sync.Mutex
+	paths map[string]*pathLock
+}
+
+func (pl *pathLocks) get(name string) *pathLock {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	if pl.paths == nil {
+		pl.paths = make(map[string]*pathLock)
+	}
+	lock, ok := pl.paths[name]
+	if !ok {
+		lock = &pathLock{}
+		pl.paths[name] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func (pl *pathLocks) put(name string, lock *pathLock) {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(pl.paths, name)
+	}
+}
+
+/* shared lock of path for reading, returns unlock function */
+func (pl *pathLocks) rlock(name string) func() {
+	lock := pl.get(name)
+	lock.RLock()
+	return func() {
+		lock.RUnlock()
+		pl.put(name, lock)
+	}
+}
+
+/* exclusive lock of paths for changes, taken in sorted order to avoid deadlocks */
+func (pl *pathLocks) wlock(names ...string) func() {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	unlocks := []func(){}
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		lock := pl.get(name)
+		lock.Lock()
+		unlocks = append(unlocks, func() {
+			lock.Unlock()
+			pl.put(name, lock)
+		})
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+/* number of paths with lock entries, for tests */
+func (pl *pathLocks) len() int {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	return len(pl.paths)
+}
@@ -0,0 +1,93 @@
+package ss3fs
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func TestSlowUploadDoesntBlockOthers(t *testing.T) {
+	cfg := &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"Put"}, Key: "slow", Latency: FaultDuration(time.Second)},
+	}}
+	fs := newFaultFs(t, cfg)
+	for _, path := range []string{"/slow", "/fast"} {
+		if errc := fs.Mknod(path, fuse.S_IFREG|0644, 0); errc != 0 {
+			t.Errorf("Mknod %s failed with %d\n", path, errc)
+			return
+		}
+	}
+	done := make(chan int)
+	go func() {
+		done <- fs.Write("/slow", []byte("data"), 0, 0)
+	}()
+	/* let write reach the store */
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if n := fs.Write("/fast", []byte("data"), 0, 0); n != 4 {
+		t.Errorf("Write of other file returned %d\n", n)
+	}
+	buff := make([]byte, 4)
+	if n := fs.Read("/fast", buff, 0, 0); n != 4 {
+		t.Errorf("Read of other file returned %d\n", n)
+	}
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/fast", &stat, 0); errc != 0 {
+		t.Errorf("Getattr of other file failed with %d\n", errc)
+	}
+	if errc := fs.Readdir("/", func(string, *fuse.Stat_t, int64) bool { return true }, 0, 0); errc != 0 {
+		t.Errorf("Readdir failed with %d\n", errc)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Operations on other file waited for slow upload, took %v\n", elapsed)
+	}
+
+	/* stat of the file being written waits for the upload */
+	if errc := fs.Getattr("/slow", &stat, 0); errc != 0 || stat.Size != 4 {
+		t.Errorf("Getattr of written file returned %d, size %d\n", errc, stat.Size)
+	}
+	if n := <-done; n != 4 {
+		t.Errorf("Slow write returned %d\n", n)
+	}
+}
+
+func TestConcurrentOpenRelease(t *testing.T) {
+	fs := newTestFs(t)
+	const files = 4
+	for i := 0; i < files; i++ {
+		if errc := fs.Mknod(fmt.Sprintf("/f%d", i), fuse.S_IFREG|0644, 0); errc != 0 {
+			t.Errorf("Mknod failed with %d\n", errc)
+			return
+		}
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/f%d", g%files)
+			for i := 0; i < 20; i++ {
+				errc, fh := fs.Open(path, fuse.O_RDWR)
+				if errc != 0 {
+					t.Errorf("Open failed with %d\n", errc)
+					return
+				}
+				if n := fs.Write(path, []byte{byte(i)}, int64(g), fh); n != 1 {
+					t.Errorf("Write returned %d\n", n)
+				}
+				fs.Release(path, fh)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if len(fs.opened) != 0 {
+		t.Errorf("%d files left open\n", len(fs.opened))
+	}
+	if n := fs.paths.len(); n != 0 {
+		t.Errorf("%d path locks left\n", n)
+	}
+}
@@ -0,0 +1,99 @@
+package ss3fs
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+/* every fuse operation gets its own id, so all records of one request can be found */
+var opSeq atomic.Uint64
+
+/* context key of the operation logger, lets S3 requests be logged with op id */
+type opLogKey struct{}
+
+type operation struct {
+	name string
+	log  *slog.Logger
+	/* cancelled on timeout, unmount or when operation ends */
+	ctx     context.Context
+	cancel  context.CancelFunc
+	start   time.Time
+	metrics *Metrics
+}
+
+func (fs *Ss3fs) beginOp(name string, path string, fh uint64) *operation {
+	log := fs.log.With("op", name, "op_id", opSeq.Add(1), "path", path, "fh", fh)
+	op := &operation{
+		name:    name,
+		log:     log,
+		start:   time.Now(),
+		metrics: fs.metrics,
+	}
+	ctx := context.WithValue(fs.ctx, opLogKey{}, log)
+	if timeout := fs.opts.opTimeout(name); timeout > 0 {
+		op.ctx, op.cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		op.ctx, op.cancel = context.WithCancel(ctx)
+	}
+	return op
+}
+
+/* result is errno (negative) or number of bytes */
+func (op *operation) end(result *int) {
+	op.cancel()
+	duration := time.Since(op.start)
+	op.log.Debug("done", "result", *result, "duration", duration)
+	op.metrics.fuseOp(op.name, *result, duration)
+}
+
+/* logs failed backend call, with request id assigned by S3 if there is one */
+func (op *operation) fail(msg string, err error) int {
+	errc := errno(err)
+	attrs := []any{"err", err, "errno", -errc}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		attrs = append(attrs, "request_id", respErr.ServiceRequestID())
+	}
+	op.log.Error(msg, attrs...)
+	return errc
+}
+
+/* debug record for every S3 request, including retries */
+func logRequests(log *slog.Logger) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		/* first deserialize step sees metadata filled by all the others */
+		return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("ss3fsRequestLog",
+			func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (
+				middleware.DeserializeOutput, middleware.Metadata, error) {
+				start := time.Now()
+				out, md, err := next.HandleDeserialize(ctx, in)
+
+				reqLog, ok := ctx.Value(opLogKey{}).(*slog.Logger)
+				if !ok {
+					reqLog = log
+				}
+				requestID, _ := awsmiddleware.GetRequestIDMetadata(md)
+				attrs := []any{
+					"s3_op", awsmiddleware.GetOperationName(ctx),
+					"request_id", requestID,
+					"duration", time.Since(start),
+				}
+				if resp, ok := out.RawResponse.(*smithyhttp.Response); ok {
+					attrs = append(attrs, "status", resp.StatusCode)
+				}
+				if err != nil {
+					attrs = append(attrs, "err", err)
+				}
+				reqLog.Debug("s3 request", attrs...)
+				return out, md, err
+			}), middleware.Before)
+	}
+}
@@ -0,0 +1,230 @@
+package ss3fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoSuchUpload = errors.New("multipart upload doesn't exist")
+)
+
+/* MemStore keeps objects in memory, used to test file system without S3 */
+type MemStore struct {
+	lock    sync.Mutex
+	objects map[string]*memObject
+	uploads map[string]*memUpload
+	nextID  uint64
+}
+
+type memObject struct {
+	data  []byte
+	etag  string
+	mtime time.Time
+	meta  map[string]string
+}
+
+type memUpload struct {
+	key   string
+	parts map[int32][]byte
+	meta  map[string]string
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		objects: make(map[string]*memObject),
+		uploads: make(map[string]*memUpload),
+	}
+}
+
+func memETag(data []byte) string {
+	sum := md5.Sum(data)
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+func (st *MemStore) BucketExists(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (st *MemStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	obj, ok := st.objects[key]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotExist, key)
+	}
+	return ObjectInfo{Key: key, Size: int64(len(obj.data)), ETag: obj.etag, LastModified: obj.mtime, Metadata: maps.Clone(obj.meta)}, nil
+}
+
+func (st *MemStore) GetRange(ctx context.Context, key string, ofst int64, length int64, etag string) (io.ReadCloser, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	obj, ok := st.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotExist, key)
+	}
+	if err := st.check(key, Condition{IfMatch: etag}); err != nil {
+		return nil, err
+	}
+	size := int64(len(obj.data))
+	if ofst > size {
+		ofst = size
+	}
+	end := ofst + length
+	if end > size {
+		end = size
+	}
+	/* objects are never modified in place, slice stays valid */
+	return io.NopCloser(bytes.NewReader(obj.data[ofst:end])), nil
+}
+
+/* must be called under lock */
+func (st *MemStore) check(key string, cond Condition) error {
+	obj, ok := st.objects[key]
+	switch {
+	case cond.IfMatch != "" && !ok:
+		return fmt.Errorf("%w: %s", ErrNotExist, key)
+	case cond.IfMatch != "" && obj.etag != cond.IfMatch:
+		return fmt.Errorf("%w: %s has ETag %s, not %s", ErrPreconditionFailed, key, obj.etag, cond.IfMatch)
+	case cond.IfNoneMatch && ok:
+		return fmt.Errorf("%w: %s exists", ErrPreconditionFailed, key)
+	}
+	return nil
+}
+
+func (st *MemStore) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, meta map[string]string, cond Condition) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(body, size))
+	if err != nil {
+		return "", err
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if err := st.check(key, cond); err != nil {
+		return "", err
+	}
+	obj := &memObject{data: data, etag: memETag(data), mtime: time.Now(), meta: maps.Clone(meta)}
+	st.objects[key] = obj
+	return obj.etag, nil
+}
+
+func (st *MemStore) CreateMultipart(ctx context.Context, key string, meta map[string]string) (string, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.nextID++
+	id := strconv.FormatUint(st.nextID, 10)
+	st.uploads[id] = &memUpload{key: key, parts: make(map[int32][]byte), meta: maps.Clone(meta)}
+	return id, nil
+}
+
+func (st *MemStore) UploadPart(ctx context.Context, key string, uploadID string, number int32, body io.ReadSeeker, size int64) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(body, size))
+	if err != nil {
+		return "", err
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	upload, ok := st.uploads[uploadID]
+	if !ok || upload.key != key {
+		return "", fmt.Errorf("%w: %s", ErrNoSuchUpload, uploadID)
+	}
+	upload.parts[number] = data
+	return memETag(data), nil
+}
+
+func (st *MemStore) CompleteMultipart(ctx context.Context, key string, uploadID string, parts []CompletedPart, cond Condition) (string, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	upload, ok := st.uploads[uploadID]
+	if !ok || upload.key != key {
+		return "", fmt.Errorf("%w: %s", ErrNoSuchUpload, uploadID)
+	}
+	if err := st.check(key, cond); err != nil {
+		return "", err
+	}
+	var data []byte
+	for _, part := range parts {
+		partData, ok := upload.parts[part.Number]
+		if !ok || memETag(partData) != part.ETag {
+			return "", fmt.Errorf("%w: part %d of %s", ErrNoSuchUpload, part.Number, uploadID)
+		}
+		data = append(data, partData...)
+	}
+	delete(st.uploads, uploadID)
+	obj := &memObject{data: data, etag: memETag(data), mtime: time.Now(), meta: upload.meta}
+	st.objects[key] = obj
+	return obj.etag, nil
+}
+
+func (st *MemStore) AbortMultipart(ctx context.Context, key string, uploadID string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if _, ok := st.uploads[uploadID]; !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchUpload, uploadID)
+	}
+	delete(st.uploads, uploadID)
+	return nil
+}
+
+func (st *MemStore) Copy(ctx context.Context, src string, dst string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	obj, ok := st.objects[src]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotExist, src)
+	}
+	st.objects[dst] = &memObject{data: obj.data, etag: obj.etag, mtime: time.Now(), meta: obj.meta}
+	return nil
+}
+
+func (st *MemStore) Delete(ctx context.Context, key string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	delete(st.objects, key)
+	return nil
+}
+
+/* MemStore returns whole listing at once, token is never set */
+func (st *MemStore) List(ctx context.Context, prefix string, delimiter string, token string) (ListResult, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	keys := make([]string, 0, len(st.objects))
+	for key := range st.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	list := ListResult{}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					list.Prefixes = append(list.Prefixes, common)
+				}
+				continue
+			}
+		}
+		obj := st.objects[key]
+		list.Objects = append(list.Objects, ObjectInfo{
+			Key:          key,
+			Size:         int64(len(obj.data)),
+			ETag:         obj.etag,
+			LastModified: obj.mtime,
+		})
+	}
+	return list, nil
+}
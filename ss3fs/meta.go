@@ -0,0 +1,195 @@
+package ss3fs
+
+/* Metadata cache: last known metadata and listing of objects. It serves */
+/* offline mode and, while polling, notifications or a TTL keep it fresh enough, */
+/* stat and listing. Our own changes are tracked, so listings started before */
+/* them don't bring old metadata back. */
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* last known metadata of objects, nil if metadata isn't cached */
+type metaCache struct {
+	lock    sync.Mutex
+	objects map[string]ObjectInfo
+	/* when metadata of object was read */
+	fetched map[string]time.Time
+	/* keys changed by us, their metadata must be read again */
+	stale map[string]bool
+	/* objects and stale keys are a complete listing */
+	complete bool
+	listedAt time.Time
+	/* version of our last change of key, listings started before it are outdated */
+	version uint64
+	updated map[string]uint64
+}
+
+func newMetaCache() *metaCache {
+	return &metaCache{objects: make(map[string]ObjectInfo), fetched: make(map[string]time.Time),
+		stale: make(map[string]bool), updated: make(map[string]uint64)}
+}
+
+func (mc *metaCache) remember(info ObjectInfo) {
+	if mc == nil {
+		return
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.objects[info.Key] = info
+	mc.fetched[info.Key] = time.Now()
+	delete(mc.stale, info.Key)
+}
+
+func (mc *metaCache) forget(key string) {
+	if mc == nil {
+		return
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	delete(mc.objects, key)
+	delete(mc.fetched, key)
+	delete(mc.stale, key)
+	mc.version++
+	mc.updated[key] = mc.version
+}
+
+/* object exists, but its metadata changed */
+func (mc *metaCache) changed(key string) {
+	if mc == nil {
+		return
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	delete(mc.objects, key)
+	delete(mc.fetched, key)
+	mc.stale[key] = true
+	mc.version++
+	mc.updated[key] = mc.version
+}
+
+/* version to pass to relisted, taken before listing starts */
+func (mc *metaCache) current() uint64 {
+	if mc == nil {
+		return 0
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.version
+}
+
+func (mc *metaCache) recall(key string) (ObjectInfo, bool) {
+	if mc == nil {
+		return ObjectInfo{}, false
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	info, ok := mc.objects[key]
+	return info, ok
+}
+
+/* metadata read less than maxAge ago, 0 accepts any age */
+func (mc *metaCache) fresh(key string, maxAge time.Duration) (ObjectInfo, bool) {
+	if mc == nil {
+		return ObjectInfo{}, false
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	info, ok := mc.objects[key]
+	if ok && maxAge > 0 && time.Since(mc.fetched[key]) >= maxAge {
+		return ObjectInfo{}, false
+	}
+	return info, ok
+}
+
+/* complete listing replaces everything known before, see relisted */
+func (mc *metaCache) listed(objects []ObjectInfo, version uint64) []string {
+	if mc == nil {
+		return nil
+	}
+	changed := mc.relisted("", objects, version)
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.complete = true
+	mc.listedAt = time.Now()
+	return changed
+}
+
+/* complete listing of keys with prefix, started at version, replaces known ones */
+/* with prefix, except keys we changed meanwhile. Returns keys whose ETag or */
+/* modification time differ, new and removed keys */
+func (mc *metaCache) relisted(prefix string, objects []ObjectInfo, version uint64) []string {
+	if mc == nil {
+		return nil
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	var changed []string
+	now := time.Now()
+	seen := make(map[string]bool, len(objects))
+	for _, info := range objects {
+		seen[info.Key] = true
+		old, known := mc.objects[info.Key]
+		switch {
+		case mc.updated[info.Key] > version:
+			continue
+		case mc.stale[info.Key]:
+			/* changed by us, nothing to compare with */
+		case !known && mc.complete:
+			changed = append(changed, info.Key)
+		case known && (old.ETag != info.ETag || !old.LastModified.Equal(info.LastModified)):
+			changed = append(changed, info.Key)
+		}
+		mc.objects[info.Key] = info
+		mc.fetched[info.Key] = now
+		delete(mc.stale, info.Key)
+	}
+	for key := range mc.objects {
+		if strings.HasPrefix(key, prefix) && !seen[key] && mc.updated[key] <= version {
+			changed = append(changed, key)
+			delete(mc.objects, key)
+			delete(mc.fetched, key)
+		}
+	}
+	for key := range mc.stale {
+		if strings.HasPrefix(key, prefix) && !seen[key] && mc.updated[key] <= version {
+			delete(mc.stale, key)
+		}
+	}
+	for key, updated := range mc.updated {
+		if strings.HasPrefix(key, prefix) && updated <= version {
+			delete(mc.updated, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+/* known keys, sorted, true if they are a complete listing */
+/* made less than maxAge ago, 0 accepts any age */
+func (mc *metaCache) listing(maxAge time.Duration) ([]string, bool) {
+	if mc == nil {
+		return nil, false
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	keys := make([]string, 0, len(mc.objects)+len(mc.stale))
+	for key := range mc.objects {
+		keys = append(keys, key)
+	}
+	for key := range mc.stale {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	complete := mc.complete && (maxAge <= 0 || time.Since(mc.listedAt) < maxAge)
+	return keys, complete
+}
+
+/* known keys, sorted */
+func (mc *metaCache) keys() []string {
+	keys, _ := mc.listing(0)
+	return keys
+}
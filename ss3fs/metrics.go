@@ -0,0 +1,186 @@
+package ss3fs
+
+import (
+	"context"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* Metrics exported for prometheus, nil *Metrics is valid and records nothing */
+type Metrics struct {
+	fuseOps            *prometheus.CounterVec
+	fuseDuration       *prometheus.HistogramVec
+	s3Requests         *prometheus.CounterVec
+	s3Errors           *prometheus.CounterVec
+	s3Bytes            *prometheus.CounterVec
+	cacheLookups       *prometheus.CounterVec
+	pendingUploadBytes prometheus.Gauge
+	uploadQueueFiles   prometheus.Gauge
+	openHandles        prometheus.Gauge
+	remoteChanges      prometheus.Counter
+	uploadConflicts    prometheus.Counter
+	uploadFailures     prometheus.Counter
+}
+
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		fuseOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ss3fs",
+			Name:      "fuse_operations_total",
+			Help:      "FUSE operations by name and result.",
+		}, []string{"op", "result"}),
+		fuseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "ss3fs",
+			Name:      "fuse_operation_duration_seconds",
+			Help:      "Latency of FUSE operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 10),
+		}, []string{"op"}),
+		s3Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ss3fs",
+			Name:      "s3_requests_total",
+			Help:      "S3 requests by API, retries are counted separately.",
+		}, []string{"api"}),
+		s3Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ss3fs",
+			Name:      "s3_request_errors_total",
+			Help:      "Failed S3 requests by API.",
+		}, []string{"api"}),
+		s3Bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ss3fs",
+			Name:      "s3_transferred_bytes_total",
+			Help:      "Bytes sent to (out) and received from (in) S3 by API.",
+		}, []string{"api", "direction"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ss3fs",
+			Name:      "cache_lookups_total",
+			Help:      "Cache lookups by cache and result (hit or miss).",
+		}, []string{"cache", "result"}),
+		pendingUploadBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "ss3fs",
+			Name:      "pending_upload_bytes",
+			Help:      "Bytes waiting for upload or being uploaded.",
+		}),
+		uploadQueueFiles: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "ss3fs",
+			Name:      "upload_queue_files",
+			Help:      "Closed files waiting for upload or being uploaded.",
+		}),
+		openHandles: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "ss3fs",
+			Name:      "open_handles",
+			Help:      "Currently open file handles.",
+		}),
+		remoteChanges: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "ss3fs",
+			Name:      "remote_changes_total",
+			Help:      "Objects found created, changed or removed by others.",
+		}),
+		uploadConflicts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "ss3fs",
+			Name:      "upload_conflicts_total",
+			Help:      "Uploads of objects changed by others since they were read.",
+		}),
+		uploadFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "ss3fs",
+			Name:      "upload_failures_total",
+			Help:      "Queued uploads given up after errors, that retries won't fix.",
+		}),
+	}
+	reg.MustRegister(m.fuseOps, m.fuseDuration, m.s3Requests, m.s3Errors, m.s3Bytes,
+		m.cacheLookups, m.pendingUploadBytes, m.uploadQueueFiles, m.openHandles,
+		m.remoteChanges, m.uploadConflicts, m.uploadFailures)
+	return m
+}
+
+func (m *Metrics) fuseOp(op string, result int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	status := "ok"
+	if result < 0 {
+		status = "error"
+	}
+	m.fuseOps.WithLabelValues(op, status).Inc()
+	m.fuseDuration.WithLabelValues(op).Observe(duration.Seconds())
+}
+
+/* caches report every lookup, hit ratio is hit / (hit + miss) */
+func (m *Metrics) cacheLookup(cache string, hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+func (m *Metrics) addPendingUpload(bytes int64) {
+	if m == nil {
+		return
+	}
+	m.pendingUploadBytes.Add(float64(bytes))
+}
+
+func (m *Metrics) addQueuedUploads(n int) {
+	if m == nil {
+		return
+	}
+	m.uploadQueueFiles.Add(float64(n))
+}
+
+func (m *Metrics) addOpenHandles(n int) {
+	if m == nil {
+		return
+	}
+	m.openHandles.Add(float64(n))
+}
+
+func (m *Metrics) addRemoteChanges(n int) {
+	if m == nil {
+		return
+	}
+	m.remoteChanges.Add(float64(n))
+}
+
+func (m *Metrics) addUploadConflict() {
+	if m == nil {
+		return
+	}
+	m.uploadConflicts.Inc()
+}
+
+func (m *Metrics) addUploadFailure() {
+	if m == nil {
+		return
+	}
+	m.uploadFailures.Inc()
+}
+
+/* counts S3 requests, errors and transferred bytes */
+func countRequests(m *Metrics) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("ss3fsRequestMetrics",
+			func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (
+				middleware.DeserializeOutput, middleware.Metadata, error) {
+				api := awsmiddleware.GetOperationName(ctx)
+				if req, ok := in.Request.(*smithyhttp.Request); ok && req.ContentLength > 0 {
+					m.s3Bytes.WithLabelValues(api, "out").Add(float64(req.ContentLength))
+				}
+				out, md, err := next.HandleDeserialize(ctx, in)
+				m.s3Requests.WithLabelValues(api).Inc()
+				if err != nil {
+					m.s3Errors.WithLabelValues(api).Inc()
+				}
+				if resp, ok := out.RawResponse.(*smithyhttp.Response); ok && resp.ContentLength > 0 {
+					m.s3Bytes.WithLabelValues(api, "in").Add(float64(resp.ContentLength))
+				}
+				return out, md, err
+			}), middleware.Before)
+	}
+}
@@ -0,0 +1,73 @@
+package ss3fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func TestMetricsFuseOps(t *testing.T) {
+	m := NewMetrics(prometheus.NewRegistry())
+	m.fuseOp("Read", 4096, time.Millisecond)
+	m.fuseOp("Read", -fuse.EIO, time.Millisecond)
+	m.fuseOp("Getattr", 0, time.Millisecond)
+	if v := testutil.ToFloat64(m.fuseOps.WithLabelValues("Read", "ok")); v != 1 {
+		t.Errorf("Wrong successful reads count %v\n", v)
+	}
+	if v := testutil.ToFloat64(m.fuseOps.WithLabelValues("Read", "error")); v != 1 {
+		t.Errorf("Wrong failed reads count %v\n", v)
+	}
+	if n := testutil.CollectAndCount(m.fuseDuration); n != 2 {
+		t.Errorf("Wrong number of latency series %d\n", n)
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	/* disabled metrics must be usable */
+	m.fuseOp("Read", 0, time.Millisecond)
+	m.cacheLookup("stat", true)
+	m.addPendingUpload(10)
+	m.addOpenHandles(1)
+}
+
+/* handles of removed and renamed files are counted until release */
+func TestMetricsOpenHandles(t *testing.T) {
+	mem := NewMemStore()
+	putString(mem, "a", "data")
+	putString(mem, "b", "data")
+	opts := DefaultOptions()
+	opts.Metrics = NewMetrics(prometheus.NewRegistry())
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	_, fa1 := fs.Open("/a", fuse.O_RDONLY)
+	_, fa2 := fs.Open("/a", fuse.O_RDONLY)
+	_, fb := fs.Open("/b", fuse.O_RDONLY)
+	fs.Unlink("/a")
+	fs.Rename("/b", "/c")
+	if v := testutil.ToFloat64(opts.Metrics.openHandles); v != 3 {
+		t.Errorf("Wrong open handles after unlink and rename %v\n", v)
+	}
+	/* kernel releases handles by their current names */
+	for _, h := range []struct {
+		path string
+		fh   uint64
+	}{{"/a", fa1}, {"/a", fa2}, {"/c", fb}} {
+		if errc := fs.Release(h.path, h.fh); errc != 0 {
+			t.Errorf("Release of %s failed with %d\n", h.path, errc)
+		}
+	}
+	if v := testutil.ToFloat64(opts.Metrics.openHandles); v != 0 {
+		t.Errorf("Wrong open handles after release %v\n", v)
+	}
+	if errc := fs.Release("/c", fb); errc != -fuse.EBADF {
+		t.Errorf("Release of closed file returned %d\n", errc)
+	}
+}
@@ -0,0 +1,83 @@
+package ss3fs
+
+/* Bucket notifications: MinIO, Ceph and AWS push S3 event JSON to a webhook, */
+/* created and removed objects are invalidated at once, without polling. */
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/* body size limit of one notification */
+const maxNotificationSize = 16 * 1024 * 1024
+
+/* S3 event notification, only fields used here */
+type bucketEvent struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				/* url encoded */
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+/* NotificationHandler accepts POSTed S3 event notifications of bucket, */
+/* events of other buckets are ignored, empty bucket accepts all */
+func (fs *Ss3fs) NotificationHandler(bucket string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "POST expected", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxNotificationSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var event bucketEvent
+		/* some servers post an empty body to check the endpoint */
+		if len(body) != 0 {
+			if err := json.Unmarshal(body, &event); err != nil {
+				fs.log.Warn("bad bucket notification", "remote", r.RemoteAddr, "err", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, record := range event.Records {
+			if bucket != "" && record.S3.Bucket.Name != bucket {
+				continue
+			}
+			key, err := url.QueryUnescape(record.S3.Object.Key)
+			if err != nil {
+				fs.log.Warn("bad key in bucket notification", "key", record.S3.Object.Key, "err", err)
+				continue
+			}
+			fs.notified(record.EventName, key)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+/* event name is like s3:ObjectCreated:Put, AWS leaves out s3: */
+func (fs *Ss3fs) notified(event string, key string) {
+	switch {
+	case strings.Contains(event, "ObjectCreated:"):
+		/* metadata isn't in event, it is read again on next use */
+		fs.meta.changed(key)
+	case strings.Contains(event, "ObjectRemoved:"):
+		fs.meta.forget(key)
+	default:
+		return
+	}
+	fs.remoteChange(key, "notification")
+}
@@ -0,0 +1,77 @@
+package ss3fs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* notification like MinIO sends it */
+func bucketNotification(event string, bucket string, key string) string {
+	return `{"EventName":"s3:` + event + `","Key":"` + bucket + `/` + key + `","Records":[{"eventVersion":"2.0",
+		"eventSource":"minio:s3","eventTime":"2024-01-01T00:00:00.000Z","eventName":"s3:` + event + `",
+		"s3":{"s3SchemaVersion":"1.0","bucket":{"name":"` + bucket + `","arn":"arn:aws:s3:::` + bucket + `"},
+		"object":{"key":"` + key + `","size":3,"eTag":"abc","sequencer":"17A"}}}]}`
+}
+
+func notify(handler http.Handler, method string, body string) int {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, "/", strings.NewReader(body)))
+	return rec.Code
+}
+
+func TestNotifications(t *testing.T) {
+	mem := NewMemStore()
+	putString(mem, "a b", "one")
+	opts := DefaultOptions()
+	opts.CacheDir = t.TempDir()
+	opts.Notifications = true
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	handler := fs.NotificationHandler("bucket")
+	buff := make([]byte, 16)
+	fs.Read("/a b", buff, 0, ^uint64(0))
+	listing(fs)
+
+	putString(mem, "a b", "changed")
+	putString(mem, "c", "new")
+	if code := notify(handler, http.MethodPost, bucketNotification("ObjectCreated:Put", "other", "a+b")); code != http.StatusOK {
+		t.Errorf("Notification failed with %d\n", code)
+	}
+	if !waitSize(fs, "/a b", 3) {
+		t.Errorf("Notification of other bucket was applied\n")
+	}
+	notify(handler, http.MethodPost, bucketNotification("ObjectCreated:Put", "bucket", "a+b"))
+	notify(handler, http.MethodPost, bucketNotification("ObjectCreated:Put", "bucket", "c"))
+	/* no polling, changes are applied at once */
+	start := time.Now()
+	if !waitSize(fs, "/a b", 7) || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Notified change wasn't applied\n")
+	}
+	if fs.cache.Size() != 0 {
+		t.Errorf("Blocks of changed object are left, cache has %d bytes\n", fs.cache.Size())
+	}
+	if names := listing(fs); len(names) != 2 {
+		t.Errorf("Notified object isn't listed %v\n", names)
+	}
+
+	mem.Delete(context.Background(), "c")
+	notify(handler, http.MethodPost, bucketNotification("ObjectRemoved:Delete", "bucket", "c"))
+	if names := listing(fs); len(names) != 1 {
+		t.Errorf("Removed object is listed %v\n", names)
+	}
+
+	if code := notify(handler, http.MethodPost, "{broken"); code != http.StatusBadRequest {
+		t.Errorf("Broken notification returned %d\n", code)
+	}
+	if code := notify(handler, http.MethodGet, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET returned %d\n", code)
+	}
+}
@@ -0,0 +1,165 @@
+package ss3fs
+
+/* Offline mode: when the object store can't be reached, known objects are still */
+/* served read-only from remembered metadata and cached blocks, until a probe */
+/* finds the store reachable again */
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrOffline = errors.New("object store is unreachable")
+)
+
+/* network failures, unlike S3 errors, mean the store can't be reached at all */
+func unreachable(err error) bool {
+	if errors.Is(err, ErrOffline) {
+		return true
+	}
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.As(err, &opErr) || errors.As(err, &dnsErr)
+}
+
+/* connection state of the store, nil if offline mode is disabled */
+type connState struct {
+	/* store without offline checks, for probes */
+	store    ObjectStore
+	interval time.Duration
+	ctx      context.Context
+	log      *slog.Logger
+	down     atomic.Bool
+}
+
+func (conn *connState) offline() bool {
+	return conn != nil && conn.down.Load()
+}
+
+/* switch to offline mode on network failure, returns err as is */
+func (conn *connState) observe(err error) error {
+	if err != nil && unreachable(err) && conn.down.CompareAndSwap(false, true) {
+		conn.log.Warn("object store is unreachable, serving cached data read-only", "err", err)
+		go conn.probe()
+	}
+	return err
+}
+
+/* wait until store answers again, any S3 answer means it is reachable */
+func (conn *connState) probe() {
+	ticker := time.NewTicker(conn.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(conn.ctx, conn.interval)
+		_, err := conn.store.BucketExists(ctx)
+		cancel()
+		if err == nil || !unreachable(err) {
+			conn.down.Store(false)
+			conn.log.Info("object store is reachable again, back online")
+			return
+		}
+	}
+}
+
+/* offlineStore fails at once while the store is unreachable */
+/* and notices when it becomes unreachable */
+type offlineStore struct {
+	store ObjectStore
+	conn  *connState
+}
+
+func (st *offlineStore) BucketExists(ctx context.Context) (bool, error) {
+	if st.conn.offline() {
+		return false, ErrOffline
+	}
+	exists, err := st.store.BucketExists(ctx)
+	return exists, st.conn.observe(err)
+}
+
+func (st *offlineStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	if st.conn.offline() {
+		return ObjectInfo{}, ErrOffline
+	}
+	info, err := st.store.Head(ctx, key)
+	return info, st.conn.observe(err)
+}
+
+func (st *offlineStore) GetRange(ctx context.Context, key string, ofst int64, length int64, etag string) (io.ReadCloser, error) {
+	if st.conn.offline() {
+		return nil, ErrOffline
+	}
+	body, err := st.store.GetRange(ctx, key, ofst, length, etag)
+	return body, st.conn.observe(err)
+}
+
+func (st *offlineStore) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, meta map[string]string, cond Condition) (string, error) {
+	if st.conn.offline() {
+		return "", ErrOffline
+	}
+	etag, err := st.store.Put(ctx, key, body, size, meta, cond)
+	return etag, st.conn.observe(err)
+}
+
+func (st *offlineStore) CreateMultipart(ctx context.Context, key string, meta map[string]string) (string, error) {
+	if st.conn.offline() {
+		return "", ErrOffline
+	}
+	id, err := st.store.CreateMultipart(ctx, key, meta)
+	return id, st.conn.observe(err)
+}
+
+func (st *offlineStore) UploadPart(ctx context.Context, key string, uploadID string, number int32, body io.ReadSeeker, size int64) (string, error) {
+	if st.conn.offline() {
+		return "", ErrOffline
+	}
+	etag, err := st.store.UploadPart(ctx, key, uploadID, number, body, size)
+	return etag, st.conn.observe(err)
+}
+
+func (st *offlineStore) CompleteMultipart(ctx context.Context, key string, uploadID string, parts []CompletedPart, cond Condition) (string, error) {
+	if st.conn.offline() {
+		return "", ErrOffline
+	}
+	etag, err := st.store.CompleteMultipart(ctx, key, uploadID, parts, cond)
+	return etag, st.conn.observe(err)
+}
+
+func (st *offlineStore) AbortMultipart(ctx context.Context, key string, uploadID string) error {
+	if st.conn.offline() {
+		return ErrOffline
+	}
+	return st.conn.observe(st.store.AbortMultipart(ctx, key, uploadID))
+}
+
+func (st *offlineStore) Copy(ctx context.Context, src string, dst string) error {
+	if st.conn.offline() {
+		return ErrOffline
+	}
+	return st.conn.observe(st.store.Copy(ctx, src, dst))
+}
+
+func (st *offlineStore) Delete(ctx context.Context, key string) error {
+	if st.conn.offline() {
+		return ErrOffline
+	}
+	return st.conn.observe(st.store.Delete(ctx, key))
+}
+
+func (st *offlineStore) List(ctx context.Context, prefix string, delimiter string, token string) (ListResult, error) {
+	if st.conn.offline() {
+		return ListResult{}, ErrOffline
+	}
+	list, err := st.store.List(ctx, prefix, delimiter, token)
+	return list, st.conn.observe(err)
+}
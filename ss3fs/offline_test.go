@@ -0,0 +1,74 @@
+package ss3fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func TestOfflineMode(t *testing.T) {
+	faults := NewFaultStore(NewMemStore(), &FaultConfig{})
+	opts := DefaultOptions()
+	opts.Retry.MaxAttempts = 1
+	opts.CacheDir = t.TempDir()
+	opts.Offline = true
+	opts.OfflineProbe = 20 * time.Millisecond
+	fs, err := NewSs3fsWithStore(faults, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	fs.Mknod("/cached", fuse.S_IFREG|0644, 0)
+	fs.Write("/cached", []byte("data"), 0, 0)
+	fs.Mknod("/other", fuse.S_IFREG|0644, 0)
+	buff := make([]byte, 4)
+	if n := fs.Read("/cached", buff, 0, 0); n != 4 {
+		t.Errorf("Read returned %d\n", n)
+		return
+	}
+	fs.Readdir("/", func(string, *fuse.Stat_t, int64) bool { return true }, 0, 0)
+
+	/* connection breaks */
+	faults.SetRules([]*FaultRule{{Reset: true}})
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/cached", &stat, 0); errc != 0 || stat.Size != 4 {
+		t.Errorf("Getattr offline returned %d, size %d\n", errc, stat.Size)
+	}
+	if !fs.conn.offline() {
+		t.Errorf("Network failure didn't switch to offline mode\n")
+		return
+	}
+	if n := fs.Read("/cached", buff, 0, 0); n != 4 || string(buff) != "data" {
+		t.Errorf("Read offline returned %d %q\n", n, buff)
+	}
+	var names []string
+	fs.Readdir("/", func(name string, _ *fuse.Stat_t, _ int64) bool {
+		names = append(names, name)
+		return true
+	}, 0, 0)
+	if len(names) != 4 || names[2] != "cached" || names[3] != "other" {
+		t.Errorf("Wrong offline listing %v\n", names)
+	}
+	if n := fs.Write("/cached", []byte("x"), 0, 0); n != -fuse.EROFS {
+		t.Errorf("Write offline returned %d\n", n)
+	}
+	if errc := fs.Getattr("/unknown", &stat, 0); errc != -fuse.ENOENT {
+		t.Errorf("Getattr of unknown object offline returned %d\n", errc)
+	}
+
+	/* connection is back */
+	faults.SetRules(nil)
+	deadline := time.Now().Add(2 * time.Second)
+	for fs.conn.offline() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fs.conn.offline() {
+		t.Errorf("Didn't switch back online\n")
+		return
+	}
+	if n := fs.Write("/cached", []byte("D"), 0, 0); n != 1 {
+		t.Errorf("Write online returned %d\n", n)
+	}
+}
@@ -0,0 +1,105 @@
+package ss3fs
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+/* Options are mount-time settings of the file system */
+type Options struct {
+	Uid      uint32
+	Gid      uint32
+	FileMode uint32
+	DirMode  uint32
+	/* slog.Default() if not set */
+	Logger *slog.Logger
+	/* log every S3 request with its request id on debug level */
+	S3Debug bool
+	/* nothing is recorded if not set */
+	Metrics *Metrics
+	/* break store calls on purpose, for debugging only */
+	Faults *FaultConfig
+	/* limits of one operation with metadata (stat, listing, rename) */
+	/* and with file data (read, write), 0 means no limit */
+	MetaTimeout time.Duration
+	DataTimeout time.Duration
+	Retry       RetryPolicy
+	/* directory of persistent block cache, no cache if empty */
+	CacheDir string
+	/* limit of cached bytes */
+	CacheSize int64
+	/* serve cached objects read-only while store is unreachable */
+	Offline bool
+	/* how often unreachable store is checked */
+	OfflineProbe time.Duration
+	/* parallel uploads of closed files, 0 uploads them inside close, like under */
+	/* ConflictFail, that reports conflicts to close */
+	UploadWorkers int
+	/* writers wait while queued uploads have more bytes */
+	UploadBudget int64
+	/* how long unmount waits for queued uploads, 0 doesn't wait */
+	UnmountTimeout time.Duration
+	/* how often recently used prefixes are listed again to find remote changes, */
+	/* metadata is cached between polls, 0 disables polling and metadata cache */
+	PollInterval time.Duration
+	/* poll only these prefixes, all the time, instead of recently used ones */
+	PollPrefixes []string
+	/* changes are pushed by bucket notifications to NotificationHandler, */
+	/* metadata is cached like with polling */
+	Notifications bool
+	/* ConsistencyTTL or ConsistencyCloseToOpen */
+	Consistency string
+	/* how long cached stat and listing are trusted, 0 doesn't cache them */
+	/* unless polling or notifications keep them fresh */
+	MetaTTL time.Duration
+	/* ConflictFail, ConflictOverwrite or ConflictSibling, what to do with */
+	/* changes of objects changed by others meanwhile */
+	Conflict string
+	/* lease of *.lock files created as advisory locks, renewed while they */
+	/* exist, 0 treats them like other files */
+	LockLease time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Uid:            uint32(os.Getuid()),
+		Gid:            uint32(os.Getgid()),
+		FileMode:       0666,
+		DirMode:        0555,
+		MetaTimeout:    30 * time.Second,
+		DataTimeout:    5 * time.Minute,
+		Retry:          DefaultRetryPolicy(),
+		CacheSize:      1024 * 1024 * 1024,
+		OfflineProbe:   5 * time.Second,
+		UploadWorkers:  4,
+		UploadBudget:   256 * 1024 * 1024,
+		UnmountTimeout: 30 * time.Second,
+		Consistency:    ConsistencyTTL,
+		Conflict:       ConflictFail,
+	}
+}
+
+/* derive file and directory permissions from umask, like mount -o umask= does */
+func (o *Options) SetUmask(umask uint32) {
+	o.FileMode = 0666 &^ umask
+	o.DirMode = 0777 &^ umask
+}
+
+func (o *Options) fileStat(stat *fuse.Stat_t) {
+	stat.Uid = o.Uid
+	stat.Gid = o.Gid
+	stat.Mode = fuse.S_IFREG | o.FileMode
+}
+
+/* operations, that move file content */
+var dataOps = map[string]bool{"Read": true, "Write": true, "Truncate": true}
+
+func (o *Options) opTimeout(op string) time.Duration {
+	if dataOps[op] {
+		return o.DataTimeout
+	}
+	return o.MetaTimeout
+}
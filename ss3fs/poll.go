@@ -0,0 +1,137 @@
+package ss3fs
+
+/* Remote change detection: other clients change the bucket too. With polling or */
+/* notifications enabled, metadata and listings are served from cache. A poller */
+/* lists recently used prefixes again, compares ETags and modification times and */
+/* invalidates cached metadata and blocks of changed objects. */
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* prefixes unused for this many intervals aren't polled anymore */
+const pollIdleIntervals = 10
+
+type poller struct {
+	lock sync.Mutex
+	/* last use of prefix */
+	used map[string]time.Time
+}
+
+/* prefix of "directory" of key, "" for keys in root */
+func keyPrefix(key string) string {
+	return key[:strings.LastIndex(key, "/")+1]
+}
+
+/* remember use of key, its prefix is polled for a while */
+func (fs *Ss3fs) touch(key string) {
+	if fs.poll == nil {
+		return
+	}
+	fs.poll.lock.Lock()
+	defer fs.poll.lock.Unlock()
+	fs.poll.used[keyPrefix(key)] = time.Now()
+}
+
+/* key is kept fresh by polling, recently used prefixes are polled once used */
+func (fs *Ss3fs) polled(key string) bool {
+	if len(fs.opts.PollPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range fs.opts.PollPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/* prefixes to poll now, hot prefixes if configured */
+func (fs *Ss3fs) pollPrefixes() []string {
+	if len(fs.opts.PollPrefixes) != 0 {
+		return fs.opts.PollPrefixes
+	}
+	fs.poll.lock.Lock()
+	defer fs.poll.lock.Unlock()
+	idle := time.Now().Add(-pollIdleIntervals * fs.opts.PollInterval)
+	var prefixes []string
+	for prefix, used := range fs.poll.used {
+		if used.Before(idle) {
+			delete(fs.poll.used, prefix)
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+func (fs *Ss3fs) startPoller() {
+	fs.poll = &poller{used: make(map[string]time.Time)}
+	go func() {
+		ticker := time.NewTicker(fs.opts.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-fs.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if fs.conn.offline() {
+				continue
+			}
+			for _, prefix := range fs.pollPrefixes() {
+				if err := fs.pollPrefix(prefix); err != nil && fs.ctx.Err() == nil {
+					fs.log.Warn("poll of remote changes failed", "prefix", prefix, "err", err)
+				}
+			}
+		}
+	}()
+}
+
+/* list prefix and invalidate caches of changed objects */
+func (fs *Ss3fs) pollPrefix(prefix string) error {
+	ctx, cancel := context.WithCancel(fs.ctx)
+	if fs.opts.MetaTimeout > 0 {
+		ctx, cancel = context.WithTimeout(fs.ctx, fs.opts.MetaTimeout)
+	}
+	defer cancel()
+	version := fs.meta.current()
+	var objects []ObjectInfo
+	token := ""
+	for {
+		result, err := fs.store.List(ctx, prefix, "", token)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, result.Objects...)
+		token = result.NextToken
+		if token == "" {
+			break
+		}
+	}
+	fs.remoteChanges(prefix, fs.meta.relisted(prefix, objects, version))
+	return nil
+}
+
+/* invalidate cached blocks of objects changed by others */
+func (fs *Ss3fs) remoteChanges(prefix string, changed []string) {
+	for _, key := range changed {
+		fs.remoteChange(key, "listing")
+	}
+	if len(changed) != 0 {
+		fs.log.Info("remote changes found", "prefix", prefix, "objects", len(changed))
+	}
+}
+
+/* metadata of key is updated by caller already */
+func (fs *Ss3fs) remoteChange(key string, source string) {
+	blocks := 0
+	if fs.cache != nil {
+		blocks = fs.cache.Invalidate(key)
+	}
+	fs.log.Debug("remote change", "key", key, "source", source, "cached_blocks", blocks)
+	fs.metrics.addRemoteChanges(1)
+}
@@ -0,0 +1,141 @@
+package ss3fs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func putString(mem *MemStore, key string, data string) {
+	mem.Put(context.Background(), key, bytes.NewReader([]byte(data)), int64(len(data)), nil, Condition{})
+}
+
+/* wait until stat of path gives size, -1 for missing object */
+func waitSize(fs *Ss3fs, path string, size int64) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var stat fuse.Stat_t
+		errc := fs.Getattr(path, &stat, ^uint64(0))
+		if (errc == 0 && stat.Size == size) || (errc == -fuse.ENOENT && size == -1) {
+			return true
+		}
+	}
+	return false
+}
+
+func listing(fs *Ss3fs) []string {
+	var names []string
+	fs.Readdir("/", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if name != "." && name != ".." {
+			names = append(names, name)
+		}
+		return true
+	}, 0, ^uint64(0))
+	return names
+}
+
+func TestRemoteChanges(t *testing.T) {
+	mem := NewMemStore()
+	putString(mem, "a", "one")
+	opts := DefaultOptions()
+	opts.CacheDir = t.TempDir()
+	opts.PollInterval = 20 * time.Millisecond
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	if names := listing(fs); len(names) != 1 {
+		t.Errorf("Wrong listing %v\n", names)
+	}
+	buff := make([]byte, 16)
+	if n := fs.Read("/a", buff, 0, ^uint64(0)); n != 3 {
+		t.Errorf("Read returned %d\n", n)
+	}
+	if fs.cache.Size() != 3 {
+		t.Errorf("Block wasn't cached, cache has %d bytes\n", fs.cache.Size())
+	}
+
+	putString(mem, "a", "changed!")
+	putString(mem, "b", "new")
+	if !waitSize(fs, "/a", 8) {
+		t.Errorf("Remote change wasn't noticed\n")
+		return
+	}
+	if fs.cache.Size() != 0 {
+		t.Errorf("Blocks of changed object are left, cache has %d bytes\n", fs.cache.Size())
+	}
+	if n := fs.Read("/a", buff, 0, ^uint64(0)); n != 8 || string(buff[:n]) != "changed!" {
+		t.Errorf("Read of changed object returned %q\n", buff[:max(n, 0)])
+	}
+	if names := listing(fs); len(names) != 2 {
+		t.Errorf("Remotely created object isn't listed %v\n", names)
+	}
+
+	mem.Delete(context.Background(), "a")
+	if !waitSize(fs, "/a", -1) {
+		t.Errorf("Remote removal wasn't noticed\n")
+	}
+	if names := listing(fs); len(names) != 1 || names[0] != "b" {
+		t.Errorf("Removed object is listed %v\n", names)
+	}
+}
+
+func TestOwnChangesWithPolling(t *testing.T) {
+	mem := NewMemStore()
+	opts := DefaultOptions()
+	opts.UploadWorkers = 0
+	opts.PollInterval = time.Hour
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	listing(fs)
+	fs.Mknod("/f", fuse.S_IFREG|0644, 0)
+	_, fh := fs.Open("/f", fuse.O_RDWR)
+	fs.Write("/f", []byte("data"), 0, fh)
+	fs.Release("/f", fh)
+	if !waitSize(fs, "/f", 4) {
+		t.Errorf("Stat of own change is stale\n")
+	}
+	fs.Rename("/f", "/g")
+	if names := listing(fs); len(names) != 1 || names[0] != "g" {
+		t.Errorf("Listing misses own changes %v\n", names)
+	}
+}
+
+func TestPollPrefixes(t *testing.T) {
+	mem := NewMemStore()
+	putString(mem, "hot/x", "one")
+	putString(mem, "cold/y", "one")
+	opts := DefaultOptions()
+	opts.PollInterval = 20 * time.Millisecond
+	opts.PollPrefixes = []string{"hot/"}
+	opts.MetaTTL = 500 * time.Millisecond
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	waitSize(fs, "/hot/x", 3)
+	waitSize(fs, "/cold/y", 3)
+	putString(mem, "hot/x", "changed")
+	putString(mem, "cold/y", "changed")
+	if !waitSize(fs, "/hot/x", 7) {
+		t.Errorf("Change under hot prefix wasn't noticed\n")
+	}
+	var stat fuse.Stat_t
+	if fs.Getattr("/cold/y", &stat, ^uint64(0)); stat.Size != 3 {
+		t.Errorf("Prefix out of scope was polled, size %d\n", stat.Size)
+	}
+	/* keys out of scope aren't trusted beyond TTL */
+	if !waitSize(fs, "/cold/y", 7) {
+		t.Errorf("Change out of polled prefixes wasn't noticed after TTL\n")
+	}
+}
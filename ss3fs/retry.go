@@ -0,0 +1,287 @@
+package ss3fs
+
+/* Retries of failed store calls, the same for S3 and any other store */
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+)
+
+type RetryPolicy struct {
+	/* attempts including the first one, 1 disables retries */
+	MaxAttempts int
+	/* delay before the first retry, doubled for every next one up to MaxBackoff */
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	/* random part of delay, 0 for exact delays, 1 for full jitter */
+	Jitter float64
+	/* S3 error codes to retry besides 5xx, throttling and network errors */
+	RetryableCodes []string
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		MinBackoff:  100 * time.Millisecond,
+		MaxBackoff:  5 * time.Second,
+		Jitter:      1,
+	}
+}
+
+/* transient S3 errors */
+var retryableCodes = []string{
+	"InternalError",
+	"ServiceUnavailable",
+	"SlowDown",
+	"RequestTimeout",
+	"RequestTimeTooSkewed",
+	"Throttling",
+	"ThrottlingException",
+	"RequestLimitExceeded",
+	"TooManyRequests",
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code := apiErr.ErrorCode()
+		if contains(retryableCodes, code) || contains(p.RetryableCodes, code) {
+			return true
+		}
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status >= 500 || status == 429
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+/* throttling, the request surely wasn't applied */
+var rejectedCodes = []string{
+	"SlowDown",
+	"ServiceUnavailable",
+	"Throttling",
+	"ThrottlingException",
+	"RequestLimitExceeded",
+	"TooManyRequests",
+}
+
+/* conditional writes are retried only after these errors: if a write failed */
+/* ambiguously but was applied, its retry fails the condition on our own object */
+func (p *RetryPolicy) rejected(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && contains(rejectedCodes, apiErr.ErrorCode()) {
+		return true
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status == 503 || status == 429
+	}
+	return false
+}
+
+/* delay before retry after attempt, counted from 1 */
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.MinBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxBackoff)
+	jitter := time.Duration(p.Jitter * float64(delay) * rand.Float64())
+	return delay - jitter
+}
+
+/* retryStore repeats failed calls of wrapped store according to policy */
+type retryStore struct {
+	store  ObjectStore
+	policy RetryPolicy
+}
+
+func (st *retryStore) do(ctx context.Context, body io.Seeker, call func() error) error {
+	return st.retry(ctx, body, st.policy.retryable, call)
+}
+
+/* like do, conditional writes are retried after rejected requests only */
+func (st *retryStore) doConditional(ctx context.Context, body io.Seeker, cond Condition, call func() error) error {
+	if cond == (Condition{}) {
+		return st.do(ctx, body, call)
+	}
+	return st.retry(ctx, body, st.policy.rejected, call)
+}
+
+func (st *retryStore) retry(ctx context.Context, body io.Seeker, retryable func(error) bool, call func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= st.policy.MaxAttempts || !retryable(err) {
+			return err
+		}
+		if log, ok := ctx.Value(opLogKey{}).(*slog.Logger); ok {
+			log.Debug("retrying store call", "attempt", attempt, "err", err)
+		}
+		select {
+		case <-time.After(st.policy.backoff(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+		/* body is sent again from the start */
+		if body != nil {
+			if _, seekErr := body.Seek(0, io.SeekStart); seekErr != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (st *retryStore) BucketExists(ctx context.Context) (exists bool, err error) {
+	err = st.do(ctx, nil, func() error {
+		exists, err = st.store.BucketExists(ctx)
+		return err
+	})
+	return
+}
+
+func (st *retryStore) Head(ctx context.Context, key string) (info ObjectInfo, err error) {
+	err = st.do(ctx, nil, func() error {
+		info, err = st.store.Head(ctx, key)
+		return err
+	})
+	return
+}
+
+func (st *retryStore) GetRange(ctx context.Context, key string, ofst int64, length int64, etag string) (body io.ReadCloser, err error) {
+	err = st.do(ctx, nil, func() error {
+		body, err = st.store.GetRange(ctx, key, ofst, length, etag)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resumingBody{st: st, ctx: ctx, key: key, etag: etag, ofst: ofst, left: length, body: body, attempt: 1}, nil
+}
+
+/* body of GetRange, that is requested again from the current offset after */
+/* read errors, e.g. reset connection, within attempts of retry policy */
+type resumingBody struct {
+	st  *retryStore
+	ctx context.Context
+	key string
+	/* rest may come from another object, unless etag is set */
+	etag string
+	ofst int64
+	left int64
+	body io.ReadCloser
+	/* requests of body so far */
+	attempt int
+}
+
+func (b *resumingBody) Read(buff []byte) (int, error) {
+	n, err := b.body.Read(buff)
+	b.ofst += int64(n)
+	b.left -= int64(n)
+	if err == nil || err == io.EOF || !b.resume(err) {
+		return n, err
+	}
+	if n == 0 {
+		return b.Read(buff)
+	}
+	return n, nil
+}
+
+/* replace body after read error, false if it can't be resumed */
+func (b *resumingBody) resume(err error) bool {
+	for b.attempt < b.st.policy.MaxAttempts && b.st.policy.retryable(err) {
+		if log, ok := b.ctx.Value(opLogKey{}).(*slog.Logger); ok {
+			log.Debug("resuming body of store call", "attempt", b.attempt, "ofst", b.ofst, "err", err)
+		}
+		select {
+		case <-time.After(b.st.policy.backoff(b.attempt)):
+		case <-b.ctx.Done():
+			return false
+		}
+		b.attempt++
+		var body io.ReadCloser
+		body, err = b.st.store.GetRange(b.ctx, b.key, b.ofst, b.left, b.etag)
+		if err == nil {
+			b.body.Close()
+			b.body = body
+			return true
+		}
+	}
+	return false
+}
+
+func (b *resumingBody) Close() error {
+	return b.body.Close()
+}
+
+func (st *retryStore) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, meta map[string]string, cond Condition) (etag string, err error) {
+	err = st.doConditional(ctx, body, cond, func() error {
+		etag, err = st.store.Put(ctx, key, body, size, meta, cond)
+		return err
+	})
+	return
+}
+
+func (st *retryStore) CreateMultipart(ctx context.Context, key string, meta map[string]string) (id string, err error) {
+	err = st.do(ctx, nil, func() error {
+		id, err = st.store.CreateMultipart(ctx, key, meta)
+		return err
+	})
+	return
+}
+
+func (st *retryStore) UploadPart(ctx context.Context, key string, uploadID string, number int32, body io.ReadSeeker, size int64) (etag string, err error) {
+	err = st.do(ctx, body, func() error {
+		etag, err = st.store.UploadPart(ctx, key, uploadID, number, body, size)
+		return err
+	})
+	return
+}
+
+func (st *retryStore) CompleteMultipart(ctx context.Context, key string, uploadID string, parts []CompletedPart, cond Condition) (etag string, err error) {
+	err = st.doConditional(ctx, nil, cond, func() error {
+		etag, err = st.store.CompleteMultipart(ctx, key, uploadID, parts, cond)
+		return err
+	})
+	return
+}
+
+func (st *retryStore) AbortMultipart(ctx context.Context, key string, uploadID string) error {
+	return st.do(ctx, nil, func() error {
+		return st.store.AbortMultipart(ctx, key, uploadID)
+	})
+}
+
+func (st *retryStore) Copy(ctx context.Context, src string, dst string) error {
+	return st.do(ctx, nil, func() error {
+		return st.store.Copy(ctx, src, dst)
+	})
+}
+
+func (st *retryStore) Delete(ctx context.Context, key string) error {
+	return st.do(ctx, nil, func() error {
+		return st.store.Delete(ctx, key)
+	})
+}
+
+func (st *retryStore) List(ctx context.Context, prefix string, delimiter string, token string) (list ListResult, err error) {
+	err = st.do(ctx, nil, func() error {
+		list, err = st.store.List(ctx, prefix, delimiter, token)
+		return err
+	})
+	return
+}
@@ -0,0 +1,140 @@
+package ss3fs
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func newRetryFs(t *testing.T, cfg *FaultConfig, opts Options) *Ss3fs {
+	opts.Faults = cfg
+	opts.Retry.MinBackoff = time.Millisecond
+	fs, err := NewSs3fsWithStore(NewMemStore(), opts)
+	if err != nil {
+		t.Fatalf("Can't create file system, error: %v\n", err)
+	}
+	return fs
+}
+
+func TestRetryPolicy(t *testing.T) {
+	cfg := &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"Put"}, Key: "file", Error: "SlowDown", Count: 2},
+		{Ops: []string{"Put"}, Key: "denied", Error: "AccessDenied", Count: 1},
+	}}
+	fs := newRetryFs(t, cfg, DefaultOptions())
+	fs.Mknod("/file", fuse.S_IFREG|0644, 0)
+	errc, fh := fs.Open("/file", fuse.O_RDWR)
+	if errc != 0 {
+		t.Errorf("Can't open file, errc: %d\n", errc)
+		return
+	}
+	defer fs.Release("/file", fh)
+	/* two throttled puts, the third one sends the whole body again */
+	if n := fs.Write("/file", []byte("data"), 0, fh); n != 4 {
+		t.Errorf("Write wasn't retried, result %d\n", n)
+	}
+	buff := make([]byte, 10)
+	if n := fs.Read("/file", buff, 0, fh); n != 4 || string(buff[:n]) != "data" {
+		t.Errorf("Wrong content after retries %q\n", buff[:max(n, 0)])
+	}
+	/* permanent errors aren't retried */
+	if errc := fs.Mknod("/denied", fuse.S_IFREG|0644, 0); errc != -fuse.EACCES {
+		t.Errorf("Denied create returned %d\n", errc)
+	}
+}
+
+/* broken bodies are read on from where they broke */
+func TestRetryTruncatedBody(t *testing.T) {
+	cfg := &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"GetRange"}, Key: "truncated", Truncate: 3, Count: 1},
+		{Ops: []string{"GetRange"}, Key: "reset", Truncate: 2, Reset: true, Count: 2},
+		{Ops: []string{"GetRange"}, Key: "broken", Truncate: 1},
+	}}
+	opts := DefaultOptions()
+	opts.UploadWorkers = 0
+	fs := newRetryFs(t, cfg, opts)
+	defer fs.Destroy()
+	for _, name := range []string{"truncated", "reset", "broken"} {
+		fs.store.Put(context.Background(), name, strings.NewReader("0123456789"), 10, nil, Condition{})
+	}
+	buff := make([]byte, 20)
+	for _, name := range []string{"/truncated", "/reset"} {
+		_, fh := fs.Open(name, fuse.O_RDONLY)
+		if n := fs.Read(name, buff, 0, fh); n != 10 || string(buff[:n]) != "0123456789" {
+			t.Errorf("Wrong content of %s after broken body %q\n", name, buff[:max(n, 0)])
+		}
+		fs.Release(name, fh)
+	}
+	/* attempts of retry policy are used up */
+	_, fh := fs.Open("/broken", fuse.O_RDONLY)
+	if n := fs.Read("/broken", buff, 0, fh); n != -fuse.EIO {
+		t.Errorf("Body broken for good returned %d\n", n)
+	}
+	fs.Release("/broken", fh)
+}
+
+func TestOpTimeoutAndUnmount(t *testing.T) {
+	cfg := &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"Head"}, Latency: FaultDuration(time.Hour)},
+	}}
+	opts := DefaultOptions()
+	opts.MetaTimeout = 20 * time.Millisecond
+	fs := newRetryFs(t, cfg, opts)
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/file", &stat, ^uint64(0)); errc != -fuse.ETIMEDOUT {
+		t.Errorf("Hung getattr returned %d\n", errc)
+	}
+
+	opts.MetaTimeout = 0
+	fs = newRetryFs(t, cfg, opts)
+	done := make(chan int)
+	go func() {
+		done <- fs.Getattr("/file", &stat, ^uint64(0))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	fs.Destroy()
+	select {
+	case errc := <-done:
+		if errc != -fuse.EINTR {
+			t.Errorf("Cancelled getattr returned %d\n", errc)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Unmount didn't cancel getattr\n")
+	}
+}
+
+/* put applied by store, but its response is lost */
+type lostResponseStore struct {
+	ObjectStore
+	puts int
+}
+
+func (st *lostResponseStore) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, meta map[string]string, cond Condition) (string, error) {
+	st.puts++
+	if _, err := st.ObjectStore.Put(ctx, key, body, size, meta, cond); err != nil {
+		return "", err
+	}
+	return "", &net.OpError{Op: "read", Net: "tcp", Err: io.ErrUnexpectedEOF}
+}
+
+func TestConditionalWriteNotRetried(t *testing.T) {
+	st := &lostResponseStore{ObjectStore: NewMemStore()}
+	fs, err := NewSs3fsWithStore(st, DefaultOptions())
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	/* retry would fail If-None-Match on our own object and report EEXIST */
+	if errc := fs.Mknod("/file", fuse.S_IFREG|0644, 0); errc == -fuse.EEXIST || errc == 0 {
+		t.Errorf("Create with lost response returned %d\n", errc)
+	}
+	if st.puts != 1 {
+		t.Errorf("Conditional create was sent %d times\n", st.puts)
+	}
+}
@@ -3,60 +3,242 @@ package ss3fs
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"net/url"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
-	"github.com/winfsp/cgofuse/fuse"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 )
 
-func BucketExists(bucket string, clnt *s3.Client, ctx *context.Context) (bool, error) {
-	exists := true
-	queryBucket := &s3.HeadBucketInput{Bucket: aws.String(bucket)}
-	_, err := clnt.HeadBucket(*ctx, queryBucket)
-	if err != nil {
-		exists = false
-		var apiErr smithy.APIError
-		/* check if request failed */
-		if errors.As(err, &apiErr) {
-			switch apiErr.(type) {
-			case *types.NotFound:
-				err = nil
-			default:
-				log.Printf("Request failed with error %v\n", err)
-			}
+/* S3Store keeps objects in one bucket of S3 compatible storage */
+type S3Store struct {
+	clnt   *s3.Client
+	bucket string
+}
+
+func NewS3Store(clnt *s3.Client, bucket string) *S3Store {
+	return &S3Store{clnt: clnt, bucket: bucket}
+}
+
+/* turn S3 "not found" and precondition errors into ErrNotExist, ErrNoSuchUpload */
+/* and ErrPreconditionFailed */
+func notFound(err error) error {
+	var apiErr smithy.APIError
+	/* check if request failed */
+	if errors.As(err, &apiErr) {
+		switch apiErr.(type) {
+		case *types.NotFound, *types.NoSuchKey:
+			return fmt.Errorf("%w: %v", ErrNotExist, err)
+		}
+		switch apiErr.ErrorCode() {
+		/* untyped for writes with If-Match */
+		case "NoSuchKey":
+			return fmt.Errorf("%w: %v", ErrNotExist, err)
+		/* upload or its parts are gone, it has to be started again */
+		case "NoSuchUpload", "InvalidPart":
+			return fmt.Errorf("%w: %v", ErrNoSuchUpload, err)
+		case "PreconditionFailed":
+			return fmt.Errorf("%w: %v", ErrPreconditionFailed, err)
 		}
 	}
-	return exists, err
+	return err
 }
 
-func ObjectExist(bucket string, object string, clnt *s3.Client, ctx *context.Context, attr *Attrs) (bool, error) {
-	exists := true
-	queryObject := &s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(object),
-	}
-	res, err := clnt.HeadObject(*ctx, queryObject)
-	if err != nil {
-		exists = false
-		var apiErr smithy.APIError
-		/* check if request failed */
-		if errors.As(err, &apiErr) {
-			switch apiErr.(type) {
-			case *types.NotFound:
-				err = nil
-			default:
-				log.Printf("Request failed with error %v\n", err)
-			}
+/* request options of conditional write, the SDK has no If-Match field for writes */
+func conditional(cond Condition) []func(*s3.Options) {
+	if cond.IfMatch == "" {
+		return nil
+	}
+	return []func(*s3.Options){func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, smithyhttp.SetHeaderValue("If-Match", cond.IfMatch))
+	}}
+}
+
+func ifNoneMatch(cond Condition) *string {
+	if !cond.IfNoneMatch {
+		return nil
+	}
+	return aws.String("*")
+}
+
+func (st *S3Store) BucketExists(ctx context.Context) (bool, error) {
+	queryBucket := &s3.HeadBucketInput{Bucket: aws.String(st.bucket)}
+	_, err := st.clnt.HeadBucket(ctx, queryBucket)
+	if err != nil {
+		err = notFound(err)
+		if errors.Is(err, ErrNotExist) {
+			err = nil
 		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (st *S3Store) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	queryObject := &s3.HeadObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(key),
+	}
+	res, err := st.clnt.HeadObject(ctx, queryObject)
+	if err != nil {
+		return ObjectInfo{}, notFound(err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(res.ContentLength),
+		ETag:         aws.ToString(res.ETag),
+		LastModified: aws.ToTime(res.LastModified),
+		Metadata:     res.Metadata,
+	}, nil
+}
+
+func (st *S3Store) GetRange(ctx context.Context, key string, ofst int64, length int64, etag string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", ofst, ofst+length-1)),
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+	result, err := st.clnt.GetObject(ctx, input)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return result.Body, nil
+}
+
+func (st *S3Store) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, meta map[string]string, cond Condition) (string, error) {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(st.bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		Metadata:      meta,
+		IfNoneMatch:   ifNoneMatch(cond),
+	}
+	res, err := st.clnt.PutObject(ctx, input, conditional(cond)...)
+	if err != nil {
+		return "", notFound(err)
+	}
+	return aws.ToString(res.ETag), nil
+}
+
+func (st *S3Store) CreateMultipart(ctx context.Context, key string, meta map[string]string) (string, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(st.bucket),
+		Key:      aws.String(key),
+		Metadata: meta,
+	}
+	res, err := st.clnt.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(res.UploadId), nil
+}
+
+func (st *S3Store) UploadPart(ctx context.Context, key string, uploadID string, number int32, body io.ReadSeeker, size int64) (string, error) {
+	input := &s3.UploadPartInput{
+		Bucket:        aws.String(st.bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int32(number),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	}
+	res, err := st.clnt.UploadPart(ctx, input)
+	if err != nil {
+		return "", notFound(err)
+	}
+	return aws.ToString(res.ETag), nil
+}
+
+func (st *S3Store) CompleteMultipart(ctx context.Context, key string, uploadID string, parts []CompletedPart, cond Condition) (string, error) {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, types.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int32(part.Number),
+		})
+	}
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(st.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+		IfNoneMatch:     ifNoneMatch(cond),
+	}
+	res, err := st.clnt.CompleteMultipartUpload(ctx, input, conditional(cond)...)
+	if err != nil {
+		return "", notFound(err)
+	}
+	return aws.ToString(res.ETag), nil
+}
+
+func (st *S3Store) AbortMultipart(ctx context.Context, key string, uploadID string) error {
+	input := &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(st.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}
+	_, err := st.clnt.AbortMultipartUpload(ctx, input)
+	return notFound(err)
+}
+
+func (st *S3Store) Copy(ctx context.Context, src string, dst string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(st.bucket),
+		Key:        aws.String(dst),
+		CopySource: aws.String(st.bucket + "/" + url.PathEscape(src)),
+	}
+	_, err := st.clnt.CopyObject(ctx, input)
+	return notFound(err)
+}
+
+func (st *S3Store) Delete(ctx context.Context, key string) error {
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(key),
+	}
+	_, err := st.clnt.DeleteObject(ctx, input)
+	return err
+}
+
+func (st *S3Store) List(ctx context.Context, prefix string, delimiter string, token string) (ListResult, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(st.bucket),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+	if token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+	res, err := st.clnt.ListObjectsV2(ctx, input)
+	if err != nil {
+		return ListResult{}, err
+	}
+	list := ListResult{}
+	for _, object := range res.Contents {
+		list.Objects = append(list.Objects, ObjectInfo{
+			Key:          aws.ToString(object.Key),
+			Size:         aws.ToInt64(object.Size),
+			ETag:         aws.ToString(object.ETag),
+			LastModified: aws.ToTime(object.LastModified),
+		})
+	}
+	for _, prefix := range res.CommonPrefixes {
+		list.Prefixes = append(list.Prefixes, aws.ToString(prefix.Prefix))
 	}
-	/* fill attrs if needed */
-	if exists && attr != nil {
-		attr.stat.Size = *res.ContentLength
-		attr.stat.Mtim = fuse.NewTimespec(*res.LastModified)
-		attr.stat.Ctim = fuse.NewTimespec(*res.LastModified)
+	if aws.ToBool(res.IsTruncated) {
+		list.NextToken = aws.ToString(res.NextContinuationToken)
 	}
-	return exists, err
+	return list, nil
 }
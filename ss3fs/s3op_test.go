@@ -0,0 +1,120 @@
+package ss3fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+	"ss3fs/internal/s3test"
+)
+
+func newS3TestFs(t *testing.T) (*Ss3fs, *s3test.Server) {
+	srv := s3test.NewServer("bucket")
+	t.Cleanup(srv.Close)
+	acc, sec, region, bucket := "test", "test", "us-east-1", "bucket"
+	fs, err := NewSs3fs(&acc, &sec, &region, &bucket, &srv.URL, DefaultOptions())
+	if err != nil {
+		t.Fatalf("Can't create file system, error: %v\n", err)
+	}
+	return fs, srv
+}
+
+func TestS3ServerFileOps(t *testing.T) {
+	fs, srv := newS3TestFs(t)
+	srv.PutObject("bucket", "existing", []byte("0123456789"))
+	if errc := fs.Mknod("/file", fuse.S_IFREG|0644, 0); errc != 0 {
+		t.Errorf("Can't create file, errc: %d\n", errc)
+		return
+	}
+	errc, fh := fs.Open("/file", fuse.O_RDWR)
+	if errc != 0 {
+		t.Errorf("Can't open file, errc: %d\n", errc)
+		return
+	}
+	fs.Write("/file", []byte("hello world"), 0, fh)
+	fs.Release("/file", fh)
+	fs.Sync(context.Background())
+	if data, _ := srv.Object("bucket", "file"); string(data) != "hello world" {
+		t.Errorf("Wrong object content %q\n", data)
+	}
+
+	errc, fh = fs.Open("/existing", fuse.O_RDONLY)
+	if errc != 0 {
+		t.Errorf("Can't open file, errc: %d\n", errc)
+		return
+	}
+	buff := make([]byte, 4)
+	if n := fs.Read("/existing", buff, 8, fh); n != 2 || string(buff[:n]) != "89" {
+		t.Errorf("Wrong read result %d %q\n", n, buff[:max(n, 0)])
+	}
+	fs.Release("/existing", fh)
+
+	if errc := fs.Rename("/existing", "/moved"); errc != 0 {
+		t.Errorf("Can't rename, errc: %d\n", errc)
+	}
+	if errc := fs.Unlink("/file"); errc != 0 {
+		t.Errorf("Can't unlink, errc: %d\n", errc)
+	}
+	if keys := srv.Keys("bucket"); len(keys) != 1 || keys[0] != "moved" {
+		t.Errorf("Wrong bucket content %v\n", keys)
+	}
+}
+
+func TestS3ServerStore(t *testing.T) {
+	fs, srv := newS3TestFs(t)
+	st := fs.store
+	ctx := context.Background()
+	if _, err := st.Head(ctx, "missing"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Head of missing object, error: %v\n", err)
+	}
+
+	id, err := st.CreateMultipart(ctx, "big", nil)
+	if err != nil {
+		t.Errorf("Can't create upload, error: %v\n", err)
+		return
+	}
+	parts := []CompletedPart{}
+	for i, chunk := range []string{"first ", "second"} {
+		etag, err := st.UploadPart(ctx, "big", id, int32(i+1), bytes.NewReader([]byte(chunk)), int64(len(chunk)))
+		if err != nil {
+			t.Errorf("Can't upload part, error: %v\n", err)
+			return
+		}
+		parts = append(parts, CompletedPart{Number: int32(i + 1), ETag: etag})
+	}
+	if _, err := st.CompleteMultipart(ctx, "big", id, parts, Condition{}); err != nil {
+		t.Errorf("Can't complete upload, error: %v\n", err)
+	}
+	if data, _ := srv.Object("bucket", "big"); string(data) != "first second" {
+		t.Errorf("Wrong object content %q\n", data)
+	}
+
+	/* listing is paginated by 1000 keys */
+	for i := 0; i < 1500; i++ {
+		srv.PutObject("bucket", "dir/"+string(rune('a'+i%26))+"/"+string(rune('a'+i/26)), nil)
+	}
+	count, token := 0, ""
+	for pages := 0; ; pages++ {
+		list, err := st.List(ctx, "dir/", "", token)
+		if err != nil {
+			t.Errorf("Can't list, error: %v\n", err)
+			return
+		}
+		count += len(list.Objects)
+		if token = list.NextToken; token == "" {
+			if pages != 1 {
+				t.Errorf("Wrong page count %d\n", pages+1)
+			}
+			break
+		}
+	}
+	if count != 1500 {
+		t.Errorf("Wrong object count %d\n", count)
+	}
+	list, err := st.List(ctx, "dir/", "/", "")
+	if err != nil || len(list.Prefixes) != 26 || len(list.Objects) != 0 {
+		t.Errorf("Wrong delimited listing %d %d, error: %v\n", len(list.Prefixes), len(list.Objects), err)
+	}
+}
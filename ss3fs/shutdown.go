@@ -0,0 +1,114 @@
+package ss3fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrShutdownTimeout = errors.New("pending updates didn't finish in time")
+	ErrChangesLeft     = errors.New("staged changes weren't uploaded")
+)
+
+/* tracks operations, that change bucket content, so they can be drained on shutdown */
+type updateTracker struct {
+	lock    sync.Mutex
+	closing bool
+	active  int
+	drained chan struct{}
+	/* unmount left changes, that didn't reach the bucket */
+	lost bool
+}
+
+/* registers update, returns false if file system doesn't accept updates now */
+func (fs *Ss3fs) beginUpdate() bool {
+	fs.updates.lock.Lock()
+	defer fs.updates.lock.Unlock()
+	/* cached data is served read-only while store is unreachable */
+	if fs.updates.closing || fs.conn.offline() {
+		return false
+	}
+	fs.updates.active++
+	return true
+}
+
+/* registers follow-up of running update, accepted while closing too */
+func (fs *Ss3fs) continueUpdate() {
+	fs.updates.lock.Lock()
+	defer fs.updates.lock.Unlock()
+	fs.updates.active++
+}
+
+func (fs *Ss3fs) endUpdate() {
+	fs.updates.lock.Lock()
+	defer fs.updates.lock.Unlock()
+	fs.updates.active--
+	if fs.updates.active == 0 && fs.updates.drained != nil {
+		close(fs.updates.drained)
+		fs.updates.drained = nil
+	}
+}
+
+/* Shutdown stops accepting updates and waits for the pending ones until ctx is done */
+/* error means some data may not have reached the bucket */
+func (fs *Ss3fs) Shutdown(ctx context.Context) error {
+	if err := fs.drainUpdates(ctx); err != nil {
+		return err
+	}
+	/* failed uploads and changes of files still open */
+	if dirty := fs.dirtyStaged(); dirty != 0 {
+		return fmt.Errorf("%w: %d files", ErrChangesLeft, dirty)
+	}
+	return nil
+}
+
+/* ChangesLost reports, if unmount gave up on changes, that didn't reach the bucket */
+func (fs *Ss3fs) ChangesLost() bool {
+	fs.updates.lock.Lock()
+	defer fs.updates.lock.Unlock()
+	return fs.updates.lost
+}
+
+func (fs *Ss3fs) dirtyStaged() int {
+	fs.lock.Lock()
+	names := make([]string, 0, len(fs.staged))
+	for name := range fs.staged {
+		names = append(names, name)
+	}
+	fs.lock.Unlock()
+	dirty := 0
+	for _, name := range names {
+		unlock := fs.paths.rlock(name)
+		if sf := fs.findStaged(name); sf != nil && sf.dirty {
+			dirty++
+		}
+		unlock()
+	}
+	return dirty
+}
+
+func (fs *Ss3fs) drainUpdates(ctx context.Context) error {
+	fs.updates.lock.Lock()
+	fs.updates.closing = true
+	if fs.updates.active == 0 {
+		fs.updates.lock.Unlock()
+		return nil
+	}
+	if fs.updates.drained == nil {
+		fs.updates.drained = make(chan struct{})
+	}
+	drained := fs.updates.drained
+	fs.updates.lock.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		fs.updates.lock.Lock()
+		active := fs.updates.active
+		fs.updates.lock.Unlock()
+		return fmt.Errorf("%w: %d still running", ErrShutdownTimeout, active)
+	}
+}
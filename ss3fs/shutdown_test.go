@@ -0,0 +1,39 @@
+package ss3fs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsUpdates(t *testing.T) {
+	fs := &Ss3fs{}
+	if !fs.beginUpdate() {
+		t.Errorf("Update was rejected before shutdown\n")
+		return
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		fs.endUpdate()
+	}()
+	err := fs.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("Shutdown failed, error: %v\n", err)
+	}
+	if fs.beginUpdate() {
+		t.Errorf("Update was accepted after shutdown\n")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	fs := &Ss3fs{}
+	fs.beginUpdate()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := fs.Shutdown(ctx)
+	if !errors.Is(err, ErrShutdownTimeout) {
+		t.Errorf("Shutdown didn't time out, error: %v\n", err)
+	}
+	fs.endUpdate()
+}
@@ -3,10 +3,11 @@ package ss3fs
 import (
 	"context"
 	"errors"
-	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -19,77 +20,281 @@ var (
 	ErrMountPointDoesntExist = errors.New("mounting bucket doesn't exist")
 )
 
+/* objects are downloaded in parts of this size for modification */
+const partSize int64 = 10 * 1024 * 1024
+
 type Ss3fs struct {
-	clnt   *s3.Client
-	ctx    *context.Context
-	bucket string /* aws string */
+	store ObjectStore
+	/* parent of all operation contexts, cancelled on unmount */
+	ctx    context.Context
+	cancel context.CancelFunc
+	/* open files, guarded by lock, which is never held during store calls */
 	opened map[string]*Attrs
+	/* name of open file by handle, empty after removal, guarded by lock */
+	handles map[uint64]string
+	lastFh  uint64
 	fuse.FileSystemBase
-	lock     sync.RWMutex
+	lock     sync.Mutex
+	paths    pathLocks
 	rootAttr fuse.Stat_t
+	opts     Options
+	updates  updateTracker
+	log      *slog.Logger
+	metrics  *Metrics
+	/* nil if reads aren't cached */
+	cache *BlockCache
+	/* both nil if offline mode is disabled */
+	conn *connState
+	meta *metaCache
+	/* changed objects waiting for upload, guarded by lock */
+	staged map[string]*stagedFile
+	/* nil if staged files are lost on restart */
+	journal   *journal
+	recovered []RecoveredFile
+	/* nil if closed files are uploaded inside FUSE calls */
+	uploads *uploadQueue
+	/* nil if polling is disabled */
+	poll *poller
+	/* nil if lock files are plain files */
+	leases *lockLeases
 }
 
 type Attrs struct {
 	stat   fuse.Stat_t
+	etag   string
 	refCnt uint64
 }
 
-func NewSs3fs(AccKey *string, SecKey *string, Region *string, Bucket *string, EndPoint *string) (*Ss3fs, error) {
+func NewSs3fs(AccKey *string, SecKey *string, Region *string, Bucket *string, EndPoint *string, opts Options) (*Ss3fs, error) {
 	/* add cred and EP validation*/
 	os.Setenv("AWS_ACCESS_KEY", *AccKey)
 	os.Setenv("AWS_SECRET_KEY", *SecKey)
 	os.Setenv("AWS_DEFAULT_REGION", *Region)
-	ctx := context.Background()
-	sdkConfig, err := config.LoadDefaultConfig(ctx)
+	sdkConfig, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
-		log.Printf("Can't initialize sdk config, error is %v\n", err)
 		return nil, err
 	}
 	sdkConfig.BaseEndpoint = EndPoint
+	log := opts.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	clnt := s3.NewFromConfig(sdkConfig, func(o *s3.Options) {
+		if opts.S3Debug {
+			o.APIOptions = append(o.APIOptions, logRequests(log))
+		}
+		if opts.Metrics != nil {
+			o.APIOptions = append(o.APIOptions, countRequests(opts.Metrics))
+		}
+		/* retries are done by retryStore with configured policy */
+		o.Retryer = aws.NopRetryer{}
+	})
+	return NewSs3fsWithStore(NewS3Store(clnt, *Bucket), opts)
+}
+
+/* file system on top of any object store */
+func NewSs3fsWithStore(store ObjectStore, opts Options) (*Ss3fs, error) {
+	if err := checkConsistency(opts.Consistency); err != nil {
+		return nil, err
+	}
+	if err := checkConflictPolicy(opts.Conflict); err != nil {
+		return nil, err
+	}
 	fs := Ss3fs{}
-	fs.clnt = s3.NewFromConfig(sdkConfig)
-	fs.ctx = &ctx
-	fs.bucket = *Bucket
+	fs.log = opts.Logger
+	if fs.log == nil {
+		fs.log = slog.Default()
+	}
+	fs.metrics = opts.Metrics
+	if opts.Faults != nil {
+		faults := NewFaultStore(store, opts.Faults)
+		faults.log = fs.log.Debug
+		store = faults
+		fs.log.Warn("fault injection is enabled", "rules", len(opts.Faults.Rules))
+	}
+	fs.store = store
+	if opts.Retry.MaxAttempts > 1 {
+		fs.store = &retryStore{store: store, policy: opts.Retry}
+	}
+	fs.store = &conditionStore{ObjectStore: fs.store, log: fs.log}
+	fs.ctx, fs.cancel = context.WithCancel(context.Background())
+	if opts.Offline {
+		fs.conn = &connState{store: fs.store, interval: opts.OfflineProbe, ctx: fs.ctx, log: fs.log}
+		fs.store = &offlineStore{store: fs.store, conn: fs.conn}
+		if opts.CacheDir == "" {
+			fs.log.Warn("offline mode without cache dir serves metadata only")
+		}
+	}
+	if opts.Offline || opts.PollInterval > 0 || opts.Notifications || opts.MetaTTL > 0 {
+		fs.meta = newMetaCache()
+	}
+	if opts.CacheDir != "" {
+		cache, err := OpenBlockCache(filepath.Join(opts.CacheDir, "blocks"), opts.CacheSize)
+		if err != nil {
+			return nil, err
+		}
+		fs.cache = cache
+		fs.log.Info("block cache opened", "dir", opts.CacheDir, "cached_bytes", cache.Size())
+		fs.journal, err = openJournal(filepath.Join(opts.CacheDir, "journal"))
+		if err != nil {
+			return nil, err
+		}
+	}
 	fs.opened = make(map[string]*Attrs)
+	fs.handles = make(map[uint64]string)
+	fs.staged = make(map[string]*stagedFile)
+	fs.opts = opts
 	fs.rootAttr = fuse.Stat_t{
 		Atim:  fuse.Now(),
 		Ctim:  fuse.Now(),
 		Mtim:  fuse.Now(),
 		Nlink: 1,
-		Gid:   uint32(os.Getgid()),
-		Uid:   uint32(os.Getuid()),
-		Mode:  fuse.S_IFDIR | 0555,
+		Gid:   opts.Gid,
+		Uid:   opts.Uid,
+		Mode:  fuse.S_IFDIR | opts.DirMode,
 	}
 	/* check if bucket exists */
-	exists, _ := BucketExists(fs.bucket, fs.clnt, fs.ctx)
+	ctx, cancel := context.WithTimeout(fs.ctx, opts.MetaTimeout)
+	if opts.MetaTimeout == 0 {
+		ctx, cancel = context.WithCancel(fs.ctx)
+	}
+	defer cancel()
+	exists, err := fs.store.BucketExists(ctx)
 	if !exists {
+		if err != nil {
+			fs.log.Error("head bucket failed", "err", err)
+		}
+		fs.cancel()
 		return nil, ErrMountPointDoesntExist
 	}
+	if fs.journal != nil {
+		if err := fs.recoverJournal(); err != nil {
+			fs.cancel()
+			return nil, err
+		}
+	}
+	if opts.UploadWorkers > 0 {
+		fs.uploads = newUploadQueue(opts.UploadBudget, fs.metrics)
+		fs.startUploads(opts.UploadWorkers)
+	}
+	if opts.PollInterval > 0 {
+		fs.startPoller()
+	}
+	if opts.LockLease > 0 {
+		fs.leases = newLockLeases()
+		fs.startLeases()
+	}
 	return &fs, nil
 }
 
+/* unmount waits for queued uploads up to UnmountTimeout, then cancels store calls */
+func (fs *Ss3fs) Destroy() {
+	ctx, cancel := context.WithTimeout(context.Background(), fs.opts.UnmountTimeout)
+	defer cancel()
+	if err := fs.Shutdown(ctx); err != nil {
+		fs.updates.lock.Lock()
+		fs.updates.lost = true
+		fs.updates.lock.Unlock()
+		fs.log.Error("unmount left changes, that didn't reach the bucket", "err", err, "journaled", fs.journal != nil)
+	}
+	if fs.uploads != nil {
+		fs.uploads.close()
+	}
+	fs.cancel()
+}
+
+/* check object and fill attrs if needed, missing object is not an error */
+func (fs *Ss3fs) objectExist(ctx context.Context, name string, attr *Attrs) (bool, error) {
+	info, exists, err := fs.headObject(ctx, name)
+	if !exists || err != nil {
+		return false, err
+	}
+	if attr != nil {
+		attr.setInfo(info)
+	}
+	return true, nil
+}
+
+/* like objectExist, with all object info */
+func (fs *Ss3fs) headObject(ctx context.Context, name string) (ObjectInfo, bool, error) {
+	info, err := fs.store.Head(ctx, name)
+	switch {
+	case errors.Is(err, ErrNotExist):
+		fs.meta.forget(name)
+		return ObjectInfo{}, false, nil
+	case err != nil && fs.conn.offline():
+		/* objects unknown while offline look missing */
+		cached, ok := fs.meta.recall(name)
+		return cached, ok, nil
+	case err != nil:
+		return ObjectInfo{}, false, err
+	}
+	fs.meta.remember(info)
+	return info, true, nil
+}
+
+/* object attributes of fresh lookup, times set locally are kept otherwise */
+func (attr *Attrs) setObject(fresh *Attrs) {
+	attr.stat.Size = fresh.stat.Size
+	attr.etag = fresh.etag
+	attr.stat.Mtim = fresh.stat.Mtim
+	attr.stat.Ctim = fresh.stat.Ctim
+}
+
+func (attr *Attrs) setInfo(info ObjectInfo) {
+	attr.stat.Size = info.Size
+	attr.etag = info.ETag
+	attr.stat.Mtim = fuse.NewTimespec(info.LastModified)
+	attr.stat.Ctim = fuse.NewTimespec(info.LastModified)
+}
+
 func (fs *Ss3fs) Readdir(path string,
 	fill func(name string, stat *fuse.Stat_t, ofst int64) bool,
 	ofst int64,
 	fh uint64) (errc int) {
-	fs.lock.RLock()
-	defer fs.lock.RUnlock()
+	op := fs.beginOp("Readdir", path, fh)
+	defer op.end(&errc)
 	switch path {
 	case "/":
 		fill(".", nil, 0)
 		fill("..", nil, 0)
-		/* list objects in specified bucket */
-		input := &s3.ListObjectsV2Input{
-			Bucket: aws.String(fs.bucket),
+		fs.touch("")
+		if maxAge, cached := fs.metaMaxAge(""); cached {
+			keys, complete := fs.meta.listing(maxAge)
+			fs.metrics.cacheLookup("listing", complete)
+			if complete {
+				for _, key := range keys {
+					fill(key, nil, 0)
+				}
+				return 0
+			}
 		}
-		result, err := fs.clnt.ListObjectsV2(*fs.ctx, input)
-		if err != nil {
-			log.Printf("List objects failed with error %v\n", err)
-			return -fuse.EIO
+		/* list objects in specified bucket */
+		version := fs.meta.current()
+		var objects []ObjectInfo
+		token := ""
+		for {
+			result, err := fs.store.List(op.ctx, "", "", token)
+			if err != nil && fs.conn.offline() {
+				for _, key := range fs.meta.keys() {
+					fill(key, nil, 0)
+				}
+				return 0
+			}
+			if err != nil {
+				return op.fail("list objects failed", err)
+			}
+			objects = append(objects, result.Objects...)
+			token = result.NextToken
+			if token == "" {
+				break
+			}
 		}
-		for _, object := range result.Contents {
-			fill(*object.Key, nil, 0)
+		/* filled after the last page, listing may switch to cache on the way */
+		for _, object := range objects {
+			fill(object.Key, nil, 0)
 		}
+		fs.remoteChanges("", fs.meta.listed(objects, version))
 	default:
 		/* add listing of directory objects */
 		return -fuse.ENOENT
@@ -98,8 +303,8 @@ func (fs *Ss3fs) Readdir(path string,
 }
 
 func (fs *Ss3fs) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
-	fs.lock.RLock()
-	defer fs.lock.RUnlock()
+	op := fs.beginOp("Getattr", path, fh)
+	defer op.end(&errc)
 	switch path {
 	case "/":
 		*stat = fs.rootAttr
@@ -108,198 +313,329 @@ func (fs *Ss3fs) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
 	default:
 		/* erase '/' */
 		name := path[1:]
-		var attr Attrs
-		exists, err := ObjectExist(fs.bucket, name, fs.clnt, fs.ctx, &attr)
-		if exists {
-			stat.Uid = uint32(os.Getuid())
-			stat.Gid = uint32(os.Getgid())
-			/* check for permitions */
-			stat.Mode = fuse.S_IFREG | 0666
-			stat.Mtim = attr.stat.Mtim
-			stat.Ctim = attr.stat.Ctim
-			stat.Size = attr.stat.Size
+		/* wait for running change of the object */
+		defer fs.paths.rlock(name)()
+		if sf := fs.findStaged(name); sf != nil {
+			fs.opts.fileStat(stat)
+			stat.Mtim = sf.mtime
+			stat.Ctim = sf.mtime
+			stat.Size = sf.size
 			stat.Atim = fuse.Now()
 			stat.Nlink = 1
-
-		} else {
-			return -fuse.ENOENT
+			return 0
 		}
+		var attr Attrs
+		exists, err := fs.lookup(op.ctx, name, &attr)
 		if err != nil {
-			log.Printf("Head object failed with error %v\n", err)
-			return -fuse.EIO
+			return op.fail("head object failed", err)
 		}
+		if !exists {
+			return -fuse.ENOENT
+		}
+		fs.opts.fileStat(stat)
+		stat.Mtim = attr.stat.Mtim
+		stat.Ctim = attr.stat.Ctim
+		stat.Size = attr.stat.Size
+		stat.Atim = fuse.Now()
+		stat.Nlink = 1
 	}
 	return 0
 }
 
 func (fs *Ss3fs) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
-	fs.lock.RLock()
-	defer fs.lock.RUnlock()
-	endofst := ofst + int64(len(buff))
+	op := fs.beginOp("Read", path, fh)
+	defer op.end(&n)
 	name := path[1:]
-	attr, ok := fs.opened[name]
-	if !ok {
-		attr = &Attrs{}
+	defer fs.paths.rlock(name)()
+	if sf := fs.findStaged(name); sf != nil {
+		length := min(int64(len(buff)), sf.size-ofst)
+		if length <= 0 {
+			return 0
+		}
+		n, err := sf.file.ReadAt(buff[:length], ofst)
+		if err != nil && err != io.EOF {
+			return op.fail("read of staged file failed", err)
+		}
+		return n
 	}
-	attr.stat.Atim = fuse.Now()
-
-	exists, err := ObjectExist(fs.bucket, name, fs.clnt, fs.ctx, attr)
-	if endofst > attr.stat.Size {
-		endofst = attr.stat.Size
+	attr, exists, err := fs.readAttrs(op.ctx, name)
+	if err != nil {
+		return op.fail("head object failed", err)
 	}
-	if exists {
-		objRange := fmt.Sprintf("%d-%d", ofst, endofst)
-		input := &s3.GetObjectInput{
-			Bucket: aws.String(fs.bucket),
-			Key:    aws.String(name),
-			Range:  aws.String(objRange),
-		}
-		result, err := fs.clnt.GetObject(*fs.ctx, input)
-		if err != nil {
-			log.Printf("Get object failed with error %v\n", err)
-			return -fuse.EIO
+	if !exists {
+		return -fuse.ENOENT
+	}
+	n, err = fs.readObject(op.ctx, name, attr, buff, ofst)
+	if errors.Is(err, ErrPreconditionFailed) {
+		/* object was changed by others since its attributes were read */
+		fs.remoteChange(name, "read")
+		exists, err = fs.refreshAttrs(op.ctx, name, attr)
+		if err == nil && !exists {
+			return -fuse.ENOENT
 		}
-		defer result.Body.Close()
-		body, err := io.ReadAll(result.Body)
-		if err != nil {
-			log.Printf("Read content failed with error %v\n", err)
-			return -fuse.EIO
+		if err == nil {
+			n, err = fs.readObject(op.ctx, name, attr, buff, ofst)
 		}
-		n = copy(buff, body)
-		return
-	} else {
-		if err != nil {
-			log.Printf("Head object faild with error %v\n", err)
-			return -fuse.EIO
-		}
-		return -fuse.ENOENT
 	}
+	if err != nil {
+		return op.fail("read of object failed", err)
+	}
+	return n
 }
 
-func (fs *Ss3fs) Write(path string, buff []byte, ofst int64, fh uint64) (n int) {
+/* read of object with ETag of attr, 0 at end of file */
+func (fs *Ss3fs) readObject(ctx context.Context, name string, attr *Attrs, buff []byte, ofst int64) (int, error) {
+	length := int64(len(buff))
+	if ofst+length > attr.stat.Size {
+		length = attr.stat.Size - ofst
+	}
+	if length <= 0 {
+		/* end of file */
+		return 0, nil
+	}
+	if fs.cache != nil && attr.etag != "" {
+		return fs.readCached(ctx, name, attr, buff[:length], ofst)
+	}
+	body, err := fs.store.GetRange(ctx, name, ofst, length, attr.etag)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	/* short body means broken transfer, not end of file */
+	return io.ReadFull(body, buff[:length])
+}
+
+/* attributes of object again, after its ETag didn't match, also for open handles */
+func (fs *Ss3fs) refreshAttrs(ctx context.Context, name string, attr *Attrs) (bool, error) {
+	fresh := &Attrs{}
+	exists, err := fs.objectExist(ctx, name, fresh)
+	if !exists || err != nil {
+		return false, err
+	}
+	attr.setObject(fresh)
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
-	name := path[1:]
-	attr, ok := fs.opened[name]
-	if !ok {
-		attr = &Attrs{}
+	if opened := fs.opened[name]; opened != nil {
+		opened.setObject(fresh)
 	}
-	attr.stat.Atim = fuse.Now()
-	attr.stat.Mtim = fuse.Now()
+	return true, nil
+}
 
-	exists, err := ObjectExist(fs.bucket, name, fs.clnt, fs.ctx, attr)
-	if !exists {
-		return -fuse.ENOENT
+/* attributes captured by open, so reads of cached blocks don't go to store */
+func (fs *Ss3fs) readAttrs(ctx context.Context, name string) (*Attrs, bool, error) {
+	attr := &Attrs{}
+	fs.lock.Lock()
+	opened := fs.opened[name]
+	if opened != nil {
+		*attr = *opened
 	}
-	if err != nil {
-		log.Printf("Head object failed with error %v\n", err)
-		return -fuse.EIO
+	fs.lock.Unlock()
+	if opened != nil {
+		return attr, true, nil
 	}
-	file, err := os.Create("/tmp/" + name)
-	if err != nil {
-		log.Printf("Create tmp file failed with error %v\n", err)
-		return -fuse.EIO
-	}
-	defer os.Remove(file.Name())
-
-	var partSize, readOfst, endofst int64 = 10 * 1024 * 1024, 0, 0
-	/* download file in 10Mb chunks */
-	for endofst < attr.stat.Size {
-		objRange := fmt.Sprintf("%d-%d", readOfst, endofst)
-		input := &s3.GetObjectInput{
-			Bucket: aws.String(fs.bucket),
-			Key:    aws.String(name),
-			Range:  aws.String(objRange),
-		}
-		result, err := fs.clnt.GetObject(*fs.ctx, input)
+	exists, err := fs.lookup(ctx, name, attr)
+	return attr, exists, err
+}
+
+/* read through block cache, missing blocks are downloaded whole */
+func (fs *Ss3fs) readCached(ctx context.Context, name string, attr *Attrs, buff []byte, ofst int64) (int, error) {
+	n := 0
+	for n < len(buff) {
+		pos := ofst + int64(n)
+		number := pos / cacheBlockSize
+		block, err := fs.cachedBlock(ctx, name, attr, number)
 		if err != nil {
-			log.Printf("Get object failed with error %v\n", err)
-			return -fuse.EIO
+			return n, err
 		}
-		defer result.Body.Close()
-		body, err := io.ReadAll(result.Body)
+		n += copy(buff[n:], block[pos-number*cacheBlockSize:])
+	}
+	return n, nil
+}
+
+func (fs *Ss3fs) cachedBlock(ctx context.Context, name string, attr *Attrs, number int64) ([]byte, error) {
+	block, ok := fs.cache.Get(name, attr.etag, number)
+	fs.metrics.cacheLookup("block", ok)
+	if ok {
+		return block, nil
+	}
+	start := number * cacheBlockSize
+	/* block of another object must not be cached under etag */
+	body, err := fs.store.GetRange(ctx, name, start, min(cacheBlockSize, attr.stat.Size-start), attr.etag)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	block = make([]byte, min(cacheBlockSize, attr.stat.Size-start))
+	if _, err := io.ReadFull(body, block); err != nil {
+		return nil, err
+	}
+	/* read doesn't fail because of cache */
+	if err := fs.cache.Put(name, attr.etag, number, block); err != nil {
+		fs.log.Warn("caching of block failed", "key", name, "err", err)
+	}
+	return block, nil
+}
+
+/* copy object with etag into local file, part by part */
+func (fs *Ss3fs) download(ctx context.Context, name string, etag string, size int64, file *os.File) error {
+	for readOfst := int64(0); readOfst < size; readOfst += partSize {
+		body, err := fs.store.GetRange(ctx, name, readOfst, partSize, etag)
 		if err != nil {
-			log.Printf("Read content failed with error %v\n", err)
-			return -fuse.EIO
-		}
-		_, ok := file.WriteAt(body, readOfst)
-		if ok != nil {
-			log.Printf("Write into tmp file failed with error %v\n", err)
-			return -fuse.EIO
+			return err
 		}
-		readOfst = endofst
-		endofst += partSize
-		if endofst > attr.stat.Size {
-			endofst = attr.stat.Size
+		_, err = io.Copy(io.NewOffsetWriter(file, readOfst), body)
+		body.Close()
+		if err != nil {
+			return err
 		}
 	}
-	n, err = file.WriteAt(buff, ofst)
+	return nil
+}
+
+func (fs *Ss3fs) Write(path string, buff []byte, ofst int64, fh uint64) (n int) {
+	op := fs.beginOp("Write", path, fh)
+	defer op.end(&n)
+	if !fs.beginUpdate() {
+		return -fuse.EROFS
+	}
+	defer fs.endUpdate()
+	/* backpressure, before path lock, that upload of the same file needs */
+	if err := fs.uploads.wait(op.ctx); err != nil {
+		return op.fail("waiting for upload queue failed", err)
+	}
+	name := path[1:]
+	defer fs.paths.wlock(name)()
+	sf, err := fs.stage(op.ctx, name, math.MaxInt64)
+	if errors.Is(err, ErrNotExist) {
+		return -fuse.ENOENT
+	}
 	if err != nil {
-		log.Printf("Write into tmp file failed with error %v\n", err)
-		return -fuse.EIO
+		return op.fail("staging of object failed", err)
 	}
-
-	input := &s3.PutObjectInput{
-		Bucket: aws.String(fs.bucket),
-		Key:    aws.String(name),
-		Body:   file,
+	if err := fs.markDirty(op.ctx, name, sf); err != nil {
+		return op.fail("journal record failed", err)
 	}
-	_, err = fs.clnt.PutObject(*fs.ctx, input)
+	n, err = sf.file.WriteAt(buff, ofst)
 	if err != nil {
-		log.Printf("Put object failed with error %v\n", err)
-		return -fuse.EIO
+		return op.fail("write into staged file failed", err)
+	}
+	sf.size = max(sf.size, ofst+int64(n))
+	if err := fs.settle(op.ctx, name, sf); err != nil {
+		return op.fail("put object failed", err)
 	}
-	attr.stat.Size = ofst + int64(n)
 	return
 }
 
+func (fs *Ss3fs) Truncate(path string, size int64, fh uint64) (errc int) {
+	op := fs.beginOp("Truncate", path, fh)
+	defer op.end(&errc)
+	if size < 0 {
+		return -fuse.EINVAL
+	}
+	if !fs.beginUpdate() {
+		return -fuse.EROFS
+	}
+	defer fs.endUpdate()
+	name := path[1:]
+	defer fs.paths.wlock(name)()
+	/* only kept part is downloaded, the rest is zeros */
+	sf, err := fs.stage(op.ctx, name, size)
+	if errors.Is(err, ErrNotExist) {
+		return -fuse.ENOENT
+	}
+	if err != nil {
+		return op.fail("staging of object failed", err)
+	}
+	if err := fs.markDirty(op.ctx, name, sf); err != nil {
+		return op.fail("journal record failed", err)
+	}
+	if err := sf.file.Truncate(size); err != nil {
+		return op.fail("truncate of staged file failed", err)
+	}
+	sf.size = size
+	if err := fs.settle(op.ctx, name, sf); err != nil {
+		return op.fail("put object failed", err)
+	}
+	return 0
+}
+
 func (fs *Ss3fs) Mknod(path string, mode uint32, dev uint64) (errc int) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+	op := fs.beginOp("Mknod", path, ^uint64(0))
+	defer op.end(&errc)
+	if !fs.beginUpdate() {
+		return -fuse.EROFS
+	}
+	defer fs.endUpdate()
+	name := path[1:]
+	defer fs.paths.wlock(name)()
+	return fs.create(op, name)
+}
+
+/* Create creates and opens file, O_EXCL holds across hosts */
+func (fs *Ss3fs) Create(path string, flags int, mode uint32) (errc int, fh uint64) {
+	op := fs.beginOp("Create", path, ^uint64(0))
+	defer op.end(&errc)
+	if !fs.beginUpdate() {
+		return -fuse.EROFS, ^uint64(0)
+	}
+	defer fs.endUpdate()
 	name := path[1:]
+	defer fs.paths.wlock(name)()
+	errc = fs.create(op, name)
+	if errc == -fuse.EEXIST && flags&fuse.O_EXCL == 0 {
+		/* created by others after lookup, open(2) opens it then */
+		errc = 0
+	}
+	if errc != 0 {
+		return errc, ^uint64(0)
+	}
+	return fs.open(op, name)
+}
+
+/* create empty object, unless it exists, must be called under write lock of name */
+func (fs *Ss3fs) create(op *operation, name string) int {
+	fs.lock.Lock()
 	_, ok := fs.opened[name]
+	fs.lock.Unlock()
 	if ok {
 		return -fuse.EEXIST
 	}
-	exists, err := ObjectExist(fs.bucket, name, fs.clnt, fs.ctx, nil)
-	if exists {
-		return -fuse.EEXIST
-	}
-	if err != nil {
-		log.Printf("Head object failed with error %v\n", err)
-		return -fuse.EIO
-
+	var err error
+	if fs.lockFile(name) {
+		err = fs.acquireLock(op, name)
+	} else {
+		/* exists check and creation in one request, nobody can come in between */
+		_, err = fs.store.Put(op.ctx, name, emptyBody(), 0, nil, Condition{IfNoneMatch: true})
 	}
-	input := &s3.PutObjectInput{
-		Bucket: aws.String(fs.bucket),
-		Key:    aws.String(name),
+	if errors.Is(err, ErrPreconditionFailed) {
+		return -fuse.EEXIST
 	}
-	_, err = fs.clnt.PutObject(*fs.ctx, input)
 	if err != nil {
-		log.Printf("Put object failed with error %v\n", err)
-		return 0
+		return op.fail("put object failed", err)
 	}
+	fs.meta.changed(name)
 	return 0
 }
 
 func (fs *Ss3fs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+	op := fs.beginOp("Utimens", path, ^uint64(0))
+	defer op.end(&errc)
 	name := path[1:]
-	attr := fs.opened[path]
-	exists, err := ObjectExist(fs.bucket, name, fs.clnt, fs.ctx, attr)
+	defer fs.paths.wlock(name)()
+	exists, err := fs.objectExist(op.ctx, name, nil)
+	if err != nil {
+		return op.fail("head object failed", err)
+	}
 	if !exists {
 		return -fuse.ENOENT
 	}
-	if err != nil {
-		log.Printf("Head object failed with error %v\n", err)
-		return -fuse.EIO
-	}
-	if attr != nil {
+	fs.lock.Lock()
+	if attr := fs.opened[name]; attr != nil {
 		attr.stat.Atim = fuse.Now()
 		attr.stat.Ctim = fuse.Now()
 		attr.stat.Mtim = fuse.Now()
 	}
+	fs.lock.Unlock()
 	if tmsp == nil {
 		tmsp0 := fuse.Now()
 		tmsa := [2]fuse.Timespec{tmsp0, tmsp0}
@@ -309,115 +645,233 @@ func (fs *Ss3fs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
 }
 
 func (fs *Ss3fs) Open(path string, flags int) (errc int, fh uint64) {
-	fs.lock.RLock()
-	defer fs.lock.RUnlock()
+	op := fs.beginOp("Open", path, ^uint64(0))
+	defer op.end(&errc)
 	name := path[1:]
+	/* open and unlink or rename of the same object are ordered */
+	defer fs.paths.rlock(name)()
+	return fs.open(op, name)
+}
+
+/* must be called under lock of name */
+func (fs *Ss3fs) open(op *operation, name string) (int, uint64) {
+	fs.lock.Lock()
 	attr := fs.opened[name]
+	fs.lock.Unlock()
 
-	if attr == nil {
+	/* in close-to-open mode every open sees the latest object, */
+	/* not only the first one on this host */
+	fresh := attr == nil || fs.closeToOpen()
+	if fresh {
 		attr = &Attrs{}
-		exists, err := ObjectExist(fs.bucket, name, fs.clnt, fs.ctx, attr)
+		exists, err := fs.revalidate(op.ctx, name, attr)
 		if !exists {
 			if err != nil {
-				log.Printf("Head object failed with error %v\n", err)
-				return -fuse.EIO, ^uint64(0)
+				return op.fail("head object failed", err), ^uint64(0)
 			}
 			return -fuse.ENOENT, ^uint64(0)
 		}
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	/* concurrent Open of the same object may have added it meanwhile */
+	if opened, ok := fs.opened[name]; ok {
+		if fresh {
+			opened.setObject(attr)
+		}
+		attr = opened
+	} else {
 		fs.opened[name] = attr
 	}
 	attr.stat.Atim = fuse.Now()
 	attr.refCnt += 1
-	return 0, 0
+	fs.lastFh++
+	fs.handles[fs.lastFh] = name
+	fs.metrics.addOpenHandles(1)
+	return 0, fs.lastFh
 }
 
 func (fs *Ss3fs) Release(path string, fh uint64) (errc int) {
+	op := fs.beginOp("Release", path, fh)
+	defer op.end(&errc)
+	/* handle is released by the name it has now, path may be stale */
+	for {
+		fs.lock.Lock()
+		name, ok := fs.handles[fh]
+		fs.lock.Unlock()
+		if !ok {
+			return -fuse.EBADF
+		}
+		if errc, ok := fs.release(op, name, fh); ok {
+			return errc
+		}
+	}
+}
+
+/* release handle of name, false if it was renamed before name was locked */
+func (fs *Ss3fs) release(op *operation, name string, fh uint64) (int, bool) {
+	if name != "" {
+		defer fs.paths.wlock(name)()
+	}
 	fs.lock.Lock()
-	defer fs.lock.Unlock()
+	if current, ok := fs.handles[fh]; !ok || current != name {
+		fs.lock.Unlock()
+		return 0, false
+	}
+	delete(fs.handles, fh)
+	fs.metrics.addOpenHandles(-1)
+	if name == "" {
+		/* removed file has nothing to upload */
+		fs.lock.Unlock()
+		return 0, true
+	}
+	attr := fs.opened[name]
+	attr.refCnt--
+	last := attr.refCnt <= 0
+	if last {
+		delete(fs.opened, name)
+	}
+	fs.lock.Unlock()
+	if !last {
+		return 0, true
+	}
+	/* the last handle uploads changes */
+	return fs.flushPath(op, name, true, fs.closeToOpen()), true
+}
 
-	name := path[1:]
-	attr, ok := fs.opened[name]
-	if ok {
-		attr.refCnt--
-		if attr.refCnt <= 0 {
-			delete(fs.opened, name)
+/* open handles of name stay valid until release, but don't refer to it anymore */
+func (fs *Ss3fs) orphan(name string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for fh, bound := range fs.handles {
+		if bound == name {
+			fs.handles[fh] = ""
 		}
-		return 0
 	}
-	return -fuse.EBADF
+	delete(fs.opened, name)
 }
 
-func (fs *Ss3fs) Unlink(path string) (errc int) {
+/* open handles of renamed file follow it to the new name, false if there are none */
+func (fs *Ss3fs) moveHandles(name string, newName string) bool {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
+	attr, ok := fs.opened[name]
+	if !ok {
+		return false
+	}
+	for fh, bound := range fs.handles {
+		if bound == name {
+			fs.handles[fh] = newName
+		}
+	}
+	/* copy has a new ETag, next changes are based on it */
+	attr.etag = ""
+	fs.opened[newName] = attr
+	delete(fs.opened, name)
+	return true
+}
 
-	name := path[:]
-	_, ok := fs.opened[name]
-	if ok {
-		delete(fs.opened, name)
+func (fs *Ss3fs) Flush(path string, fh uint64) (errc int) {
+	op := fs.beginOp("Flush", path, fh)
+	defer op.end(&errc)
+	name := path[1:]
+	defer fs.paths.wlock(name)()
+	return fs.flushPath(op, name, false, fs.closeToOpen())
+}
+
+func (fs *Ss3fs) Fsync(path string, datasync bool, fh uint64) (errc int) {
+	op := fs.beginOp("Fsync", path, fh)
+	defer op.end(&errc)
+	name := path[1:]
+	defer fs.paths.wlock(name)()
+	/* data must be in bucket when fsync returns */
+	return fs.flushPath(op, name, false, true)
+}
+
+func (fs *Ss3fs) Unlink(path string) (errc int) {
+	op := fs.beginOp("Unlink", path, ^uint64(0))
+	defer op.end(&errc)
+	if !fs.beginUpdate() {
+		return -fuse.EROFS
 	}
-	exists, err := ObjectExist(fs.bucket, name, fs.clnt, fs.ctx, nil)
+	defer fs.endUpdate()
+	name := path[1:]
+	defer fs.paths.wlock(name)()
+	exists, err := fs.objectExist(op.ctx, name, nil)
 	if !exists {
 		if err != nil {
-			log.Printf("Head object failed with error %v\n", err)
-			return -fuse.EIO
+			return op.fail("head object failed", err)
 		}
 		return -fuse.ENOENT
 	}
-	input := &s3.DeleteObjectInput{
-		Bucket: aws.String(fs.bucket),
-		Key:    aws.String(name),
-	}
-	_, err = fs.clnt.DeleteObject(*fs.ctx, input)
+	err = fs.store.Delete(op.ctx, name)
 	if err != nil {
-		log.Printf("Delte object failed with error %v\n", err)
-		return -fuse.EIO
+		return op.fail("delete object failed", err)
+	}
+	fs.orphan(name)
+	/* changes of removed file aren't uploaded, they are kept if delete failed */
+	if sf := fs.findStaged(name); sf != nil {
+		fs.dropStaged(name, sf)
+	}
+	fs.meta.forget(name)
+	if fs.leases.release(name) {
+		op.log.Debug("lock is released")
 	}
 	return 0
 }
 
-func (fs *Ss3fs) Rename(oldpath string, newpath string) int {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-
+func (fs *Ss3fs) Rename(oldpath string, newpath string) (errc int) {
+	op := fs.beginOp("Rename", oldpath, ^uint64(0))
+	defer op.end(&errc)
+	op.log = op.log.With("newpath", newpath)
+	if !fs.beginUpdate() {
+		return -fuse.EROFS
+	}
+	defer fs.endUpdate()
 	name := oldpath[1:]
 	newName := newpath[1:]
-	_, ok := fs.opened[name]
-	if ok {
-		delete(fs.opened, name)
-		//return -fuse.EBUSY
-	}
-	exists, err := ObjectExist(fs.bucket, name, fs.clnt, fs.ctx, nil)
+	defer fs.paths.wlock(name, newName)()
+	exists, err := fs.objectExist(op.ctx, name, nil)
 	if !exists {
 		if err != nil {
-			log.Printf("Head object failed with error %v\n", err)
-			return -fuse.EIO
+			return op.fail("head object failed", err)
 		}
 		return -fuse.ENOENT
 	}
-	exists, _ = ObjectExist(fs.bucket, newName, fs.clnt, fs.ctx, nil)
-	if exists {
-		return -fuse.EEXIST
+	/* rename to itself does nothing */
+	if name == newName {
+		return 0
 	}
-	copyInput := &s3.CopyObjectInput{
-		Bucket:     aws.String(fs.bucket),
-		Key:        aws.String(newName),
-		CopySource: aws.String(fs.bucket + oldpath),
+	/* object is copied with its staged changes */
+	if sf := fs.findStaged(name); sf != nil {
+		if err := fs.flushStaged(op.ctx, sf, true); err != nil {
+			return op.fail("upload of staged file failed", err)
+		}
+		fs.dropStaged(name, sf)
 	}
-	_, err = fs.clnt.CopyObject(*fs.ctx, copyInput)
+	/* existing target is replaced, like on rename(2) */
+	err = fs.store.Copy(op.ctx, name, newName)
 	if err != nil {
-		log.Printf("Copy object failed with error %v\n", err)
-		return -fuse.EIO
+		return op.fail("copy object failed", err)
 	}
-	delInput := &s3.DeleteObjectInput{
-		Bucket: aws.String(fs.bucket),
-		Key:    aws.String(name),
+	fs.orphan(newName)
+	if sf := fs.findStaged(newName); sf != nil {
+		fs.dropStaged(newName, sf)
 	}
-	_, err = fs.clnt.DeleteObject(*fs.ctx, delInput)
+	fs.leases.release(newName)
+	fs.meta.changed(newName)
+	err = fs.store.Delete(op.ctx, name)
 	if err != nil {
-		log.Printf("Delte object failed with error %v\n", err)
-		return -fuse.EIO
+		return op.fail("delete object failed", err)
 	}
+	if fs.moveHandles(name, newName) {
+		if _, err := fs.refreshAttrs(op.ctx, newName, &Attrs{}); err != nil {
+			op.log.Warn("stat of renamed open file failed", "err", err)
+		}
+	}
+	fs.meta.forget(name)
+	/* copy isn't renewed, its lease expires */
+	fs.leases.release(name)
 	return 0
 }
 
@@ -494,14 +948,6 @@ func (*Ss3fs) Access(path string, mask uint32) int {
 	return -fuse.ENOSYS
 }
 
-// Truncate changes the size of a file.
-// The Ss3fs implementation returns -fuse.ENOSYS.
-func (*Ss3fs) Truncate(path string, size int64, fh uint64) int {
-	log.Println("called truncate")
-
-	return -fuse.ENOSYS
-}
-
 // Flush flushes cached file data.
 // The Ss3fs implementation returns -fuse.ENOSYS.
 func (*Ss3fs) Flush(path string, fh uint64) int {
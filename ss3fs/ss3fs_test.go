@@ -0,0 +1,122 @@
+package ss3fs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func newTestFs(t *testing.T) *Ss3fs {
+	fs, err := NewSs3fsWithStore(NewMemStore(), DefaultOptions())
+	if err != nil {
+		t.Fatalf("Can't create file system, error: %v\n", err)
+	}
+	return fs
+}
+
+func TestMknodWriteRead(t *testing.T) {
+	fs := newTestFs(t)
+	if errc := fs.Mknod("/file", fuse.S_IFREG|0644, 0); errc != 0 {
+		t.Errorf("Can't create file, errc: %d\n", errc)
+		return
+	}
+	if errc := fs.Mknod("/file", fuse.S_IFREG|0644, 0); errc != -fuse.EEXIST {
+		t.Errorf("File was created twice, errc: %d\n", errc)
+	}
+	errc, fh := fs.Open("/file", fuse.O_RDWR)
+	if errc != 0 {
+		t.Errorf("Can't open file, errc: %d\n", errc)
+		return
+	}
+	fs.Write("/file", []byte("hello world"), 0, fh)
+	/* overwrite in the middle and append after the end */
+	fs.Write("/file", []byte("W"), 6, fh)
+	fs.Write("/file", []byte("!"), 11, fh)
+
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/file", &stat, fh); errc != 0 || stat.Size != 12 {
+		t.Errorf("Wrong attrs, errc: %d, size %d\n", errc, stat.Size)
+	}
+	buff := make([]byte, 5)
+	n := fs.Read("/file", buff, 6, fh)
+	if n != 5 || string(buff) != "World" {
+		t.Errorf("Wrong read result %d %q\n", n, buff[:max(n, 0)])
+	}
+	buff = make([]byte, 100)
+	n = fs.Read("/file", buff, 0, fh)
+	if n != 12 || !bytes.Equal(buff[:n], []byte("hello World!")) {
+		t.Errorf("Wrong read result %d %q\n", n, buff[:max(n, 0)])
+	}
+	if n := fs.Read("/file", buff, 12, fh); n != 0 {
+		t.Errorf("Read past the end returned %d\n", n)
+	}
+	if errc := fs.Release("/file", fh); errc != 0 {
+		t.Errorf("Can't release file, errc: %d\n", errc)
+	}
+}
+
+func TestRenameUnlinkReaddir(t *testing.T) {
+	fs := newTestFs(t)
+	fs.Mknod("/a", fuse.S_IFREG|0644, 0)
+	fs.Mknod("/b", fuse.S_IFREG|0644, 0)
+	if errc := fs.Rename("/a", "/b"); errc != 0 {
+		t.Errorf("Can't rename over existing file, errc: %d\n", errc)
+	}
+	if errc := fs.Rename("/b", "/c"); errc != 0 {
+		t.Errorf("Can't rename, errc: %d\n", errc)
+	}
+	fs.Mknod("/b", fuse.S_IFREG|0644, 0)
+	if errc := fs.Unlink("/b"); errc != 0 {
+		t.Errorf("Can't unlink, errc: %d\n", errc)
+	}
+	if errc := fs.Unlink("/b"); errc != -fuse.ENOENT {
+		t.Errorf("Unlink of missing file, errc: %d\n", errc)
+	}
+	names := []string{}
+	fs.Readdir("/", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		names = append(names, name)
+		return true
+	}, 0, 0)
+	if len(names) != 3 || names[2] != "c" {
+		t.Errorf("Wrong listing %v\n", names)
+	}
+}
+
+/* handle renamed while open doesn't affect a new file under its old name */
+func TestReleaseAfterRename(t *testing.T) {
+	mem := NewMemStore()
+	fs, err := NewSs3fsWithStore(mem, DefaultOptions())
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	fs.Mknod("/b", fuse.S_IFREG|0644, 0)
+	_, fh := fs.Open("/b", fuse.O_RDWR)
+	fs.Rename("/b", "/c")
+	if errc := fs.Release("/c", fh); errc != 0 {
+		t.Errorf("Release by new name failed with %d\n", errc)
+	}
+	fs.Mknod("/b", fuse.S_IFREG|0644, 0)
+	_, fh = fs.Open("/b", fuse.O_RDWR)
+	fs.Write("/b", []byte("hello"), 0, fh)
+	if errc := fs.Release("/b", fh); errc != 0 {
+		t.Errorf("Release failed with %d\n", errc)
+	}
+	fs.Sync(context.Background())
+	if data := storeContent(t, mem, "b"); string(data) != "hello" {
+		t.Errorf("Changes of new file were lost %q\n", data)
+	}
+
+	/* handle renamed with changes reads them under the new name */
+	_, fh = fs.Open("/b", fuse.O_RDWR)
+	fs.Write("/b", []byte("world"), 0, fh)
+	fs.Rename("/b", "/d")
+	buff := make([]byte, 10)
+	if n := fs.Read("/d", buff, 0, fh); n != 5 || string(buff[:n]) != "world" {
+		t.Errorf("Wrong content after rename of open file %q\n", buff[:max(n, 0)])
+	}
+	fs.Release("/d", fh)
+}
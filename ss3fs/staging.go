@@ -0,0 +1,251 @@
+package ss3fs
+
+/* Write buffering: changed objects are staged in local files and uploaded */
+/* on flush, fsync or release of the last handle. Changes of files without */
+/* open handles, e.g. truncate by path, are uploaded at once. */
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+/* local copy of object, guarded by write lock of its path */
+type stagedFile struct {
+	file  *os.File
+	size  int64
+	mtime fuse.Timespec
+	/* ETag of object the content is based on */
+	base string
+	/* changed since last upload, always with journal record then */
+	dirty bool
+	rec   *journalRecord
+}
+
+func (fs *Ss3fs) findStaged(name string) *stagedFile {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.staged[name]
+}
+
+/* stage object for changes, only first keep bytes of its content are downloaded */
+/* must be called under write lock of name */
+func (fs *Ss3fs) stage(ctx context.Context, name string, keep int64) (*stagedFile, error) {
+	if sf := fs.findStaged(name); sf != nil {
+		return sf, nil
+	}
+	var attr Attrs
+	exists, err := fs.objectExist(ctx, name, &attr)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotExist
+	}
+	file, err := fs.journal.dataFile()
+	if err != nil {
+		return nil, err
+	}
+	size := min(keep, attr.stat.Size)
+	if err := fs.download(ctx, name, attr.etag, size, file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	sf := &stagedFile{file: file, size: size, mtime: attr.stat.Mtim, base: fs.openedETag(name, attr.etag)}
+	fs.lock.Lock()
+	fs.staged[name] = sf
+	fs.lock.Unlock()
+	return sf, nil
+}
+
+/* changes of open file are based on the object, that was opened, */
+/* current is the ETag of object now */
+func (fs *Ss3fs) openedETag(name string, current string) string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if attr := fs.opened[name]; attr != nil && attr.etag != "" {
+		return attr.etag
+	}
+	return current
+}
+
+/* open file refers to object uploaded with etag and size, next changes are based on it */
+func (fs *Ss3fs) rebase(name string, etag string, size int64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if attr := fs.opened[name]; attr != nil {
+		attr.etag = etag
+		attr.stat.Size = size
+	}
+}
+
+/* must be called before data of staged file changes */
+func (fs *Ss3fs) markDirty(ctx context.Context, name string, sf *stagedFile) error {
+	switch {
+	case sf.rec == nil:
+		/* downloaded content must be on disk before record points to it */
+		if fs.journal != nil {
+			if err := sf.file.Sync(); err != nil {
+				return err
+			}
+		}
+		rec := &journalRecord{Key: name, Data: filepath.Base(sf.file.Name()), Base: sf.base}
+		if err := fs.journal.save(rec); err != nil {
+			return err
+		}
+		sf.rec = rec
+	case sf.rec.UploadID != "":
+		/* uploaded parts of failed upload are stale now */
+		if err := fs.store.AbortMultipart(ctx, name, sf.rec.UploadID); err != nil {
+			fs.log.Warn("abort of stale upload failed", "key", name, "err", err)
+		}
+		sf.rec.UploadID, sf.rec.Parts = "", nil
+		if err := fs.journal.save(sf.rec); err != nil {
+			return err
+		}
+	}
+	sf.dirty = true
+	sf.mtime = fuse.Now()
+	return nil
+}
+
+/* upload changes of staged file, must be called under write lock of name */
+/* report tells, if caller returns errors to application, see uploadResolved */
+/* conflicting changes stay staged and journaled, or are saved as sibling */
+func (fs *Ss3fs) flushStaged(ctx context.Context, sf *stagedFile, report bool) error {
+	if !sf.dirty {
+		return nil
+	}
+	name := sf.rec.Key
+	fs.metrics.addPendingUpload(sf.size)
+	etag, sibling, err := fs.uploadResolved(ctx, sf.rec, sf.file, sf.size, report)
+	fs.metrics.addPendingUpload(-sf.size)
+	if errors.Is(err, ErrConflict) {
+		/* lock file changed by others isn't ours anymore */
+		fs.leases.release(name)
+	}
+	if err != nil {
+		return err
+	}
+	fs.meta.changed(name)
+	fs.journal.remove(sf.rec)
+	sf.rec = nil
+	sf.dirty = false
+	if sibling != "" {
+		fs.meta.changed(sibling)
+		fs.leases.release(name)
+		/* object has content of others, it is read again on next use */
+		fs.dropStaged(name, sf)
+		if _, err := fs.refreshAttrs(ctx, name, &Attrs{}); err != nil {
+			fs.log.Warn("stat after conflict failed", "key", name, "err", err)
+		}
+		return nil
+	}
+	sf.base = etag
+	fs.rebase(name, etag, sf.size)
+	fs.leases.update(name, etag)
+	return nil
+}
+
+/* forget staged file with its changes, must be called under write lock of name */
+func (fs *Ss3fs) dropStaged(name string, sf *stagedFile) {
+	fs.lock.Lock()
+	if fs.staged[name] != sf {
+		/* dropped already */
+		fs.lock.Unlock()
+		return
+	}
+	delete(fs.staged, name)
+	fs.lock.Unlock()
+	if sf.rec != nil {
+		fs.journal.remove(sf.rec)
+	}
+	sf.file.Close()
+	os.Remove(sf.file.Name())
+}
+
+/* upload and drop staged file, if nobody has it open */
+func (fs *Ss3fs) settle(ctx context.Context, name string, sf *stagedFile) error {
+	fs.lock.Lock()
+	_, open := fs.opened[name]
+	fs.lock.Unlock()
+	if open {
+		return nil
+	}
+	if err := fs.flushStaged(ctx, sf, true); err != nil {
+		return err
+	}
+	fs.dropStaged(name, sf)
+	return nil
+}
+
+/* upload file as object, big ones in parts, progress is kept in journal record */
+/* object must still have base ETag of record, returns ETag of the new one */
+func (fs *Ss3fs) uploadFile(ctx context.Context, rec *journalRecord, file io.ReaderAt, size int64) (string, error) {
+	cond := Condition{IfMatch: rec.Base}
+	/* held lock file keeps its lease */
+	meta := fs.heldLease(rec.Key)
+	if size <= partSize {
+		return fs.store.Put(ctx, rec.Key, io.NewSectionReader(file, 0, size), size, meta, cond)
+	}
+	if rec.UploadID == "" {
+		id, err := fs.store.CreateMultipart(ctx, rec.Key, meta)
+		if err != nil {
+			return "", err
+		}
+		rec.UploadID, rec.Parts = id, nil
+		if err := fs.journal.save(rec); err != nil {
+			return "", err
+		}
+	}
+	/* parts uploaded before crash or failure are skipped */
+	for ofst := int64(len(rec.Parts)) * partSize; ofst < size; ofst += partSize {
+		length := min(partSize, size-ofst)
+		number := int32(len(rec.Parts) + 1)
+		etag, err := fs.store.UploadPart(ctx, rec.Key, rec.UploadID, number, io.NewSectionReader(file, ofst, length), length)
+		if err != nil {
+			return "", err
+		}
+		rec.Parts = append(rec.Parts, CompletedPart{Number: number, ETag: etag})
+		if err := fs.journal.save(rec); err != nil {
+			return "", err
+		}
+	}
+	return fs.store.CompleteMultipart(ctx, rec.Key, rec.UploadID, rec.Parts, cond)
+}
+
+/* upload changes of staged file of path, drop it afterwards if asked */
+/* upload is queued unless it must be done now, must be called under write lock of name */
+func (fs *Ss3fs) flushPath(op *operation, name string, drop bool, now bool) int {
+	sf := fs.findStaged(name)
+	if sf == nil {
+		return 0
+	}
+	if sf.dirty && fs.uploads != nil && !now && !fs.reportConflicts() {
+		if !fs.queueUpload(name, sf.size) {
+			op.log.Warn("staged changes aren't uploaded, updates aren't accepted now", "journaled", fs.journal != nil)
+			return -fuse.EROFS
+		}
+		/* worker drops file after upload, if it is closed */
+		return 0
+	}
+	if sf.dirty {
+		if !fs.beginUpdate() {
+			op.log.Warn("staged changes aren't uploaded, updates aren't accepted now", "journaled", fs.journal != nil)
+			return -fuse.EROFS
+		}
+		defer fs.endUpdate()
+		if err := fs.flushStaged(op.ctx, sf, true); err != nil {
+			return op.fail("upload of staged file failed", err)
+		}
+	}
+	if drop {
+		fs.dropStaged(name, sf)
+	}
+	return 0
+}
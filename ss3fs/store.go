@@ -0,0 +1,71 @@
+package ss3fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrNotExist = errors.New("object doesn't exist")
+	/* conditional write found object changed, like S3 412 */
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+/* ObjectInfo is what file system needs to know about stored object */
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	/* user metadata, only returned by Head, keys are lower case */
+	Metadata map[string]string
+}
+
+/* Condition of write, zero value writes unconditionally */
+type Condition struct {
+	/* ETag the replaced object must have, missing object gives ErrNotExist */
+	IfMatch string
+	/* fail if object exists, If-None-Match: * */
+	IfNoneMatch bool
+}
+
+type CompletedPart struct {
+	Number int32
+	ETag   string
+}
+
+type ListResult struct {
+	Objects []ObjectInfo
+	/* common prefixes, if listed with delimiter */
+	Prefixes []string
+	/* pass to the next List call, empty if listing is complete */
+	NextToken string
+}
+
+/* ObjectStore is a flat key-value storage of file contents, S3 bucket in production */
+/* missing objects are reported with ErrNotExist */
+type ObjectStore interface {
+	BucketExists(ctx context.Context) (bool, error)
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	/* read length bytes starting from ofst, shorter result at the end of object */
+	/* object must have etag unless it is empty, other gives ErrPreconditionFailed */
+	GetRange(ctx context.Context, key string, ofst int64, length int64, etag string) (io.ReadCloser, error)
+	/* returns ETag of the new object, failed condition gives ErrPreconditionFailed */
+	/* meta is stored as user metadata of object, keys must be lower case */
+	Put(ctx context.Context, key string, body io.ReadSeeker, size int64, meta map[string]string, cond Condition) (string, error)
+	CreateMultipart(ctx context.Context, key string, meta map[string]string) (string, error)
+	UploadPart(ctx context.Context, key string, uploadID string, number int32, body io.ReadSeeker, size int64) (string, error)
+	/* upload stays, if condition fails */
+	CompleteMultipart(ctx context.Context, key string, uploadID string, parts []CompletedPart, cond Condition) (string, error)
+	AbortMultipart(ctx context.Context, key string, uploadID string) error
+	Copy(ctx context.Context, src string, dst string) error
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string, delimiter string, token string) (ListResult, error)
+}
+
+func emptyBody() io.ReadSeeker {
+	return bytes.NewReader(nil)
+}
@@ -0,0 +1,234 @@
+package ss3fs
+
+/* Upload queue: closed files are uploaded by a pool of workers, not inside */
+/* FUSE calls. Queued bytes are limited by budget, writers wait when it is used up. */
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+type uploadJob struct {
+	name string
+	/* bytes counted against budget */
+	size int64
+}
+
+type uploadQueue struct {
+	lock sync.Mutex
+	/* broadcast on every change of queue */
+	changed *sync.Cond
+	waiting []uploadJob
+	/* names in waiting, one job per file is enough */
+	queued  map[string]bool
+	running int
+	/* bytes of waiting and running jobs */
+	bytes   int64
+	budget  int64
+	closed  bool
+	metrics *Metrics
+}
+
+func newUploadQueue(budget int64, metrics *Metrics) *uploadQueue {
+	q := &uploadQueue{queued: make(map[string]bool), budget: budget, metrics: metrics}
+	q.changed = sync.NewCond(&q.lock)
+	return q
+}
+
+/* add job, false if file is queued already */
+func (q *uploadQueue) add(job uploadJob) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.queued[job.name] || q.closed {
+		return false
+	}
+	q.queued[job.name] = true
+	q.waiting = append(q.waiting, job)
+	q.bytes += job.size
+	q.metrics.addQueuedUploads(1)
+	q.metrics.addPendingUpload(job.size)
+	q.changed.Broadcast()
+	return true
+}
+
+/* wait for job, false if queue is closed */
+func (q *uploadQueue) next() (uploadJob, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.waiting) == 0 && !q.closed {
+		q.changed.Wait()
+	}
+	if q.closed {
+		return uploadJob{}, false
+	}
+	job := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	delete(q.queued, job.name)
+	q.running++
+	/* running upload counts its bytes itself */
+	q.metrics.addPendingUpload(-job.size)
+	return job, true
+}
+
+func (q *uploadQueue) done(job uploadJob) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.running--
+	q.bytes -= job.size
+	q.metrics.addQueuedUploads(-1)
+	q.changed.Broadcast()
+}
+
+/* block while queued bytes are over budget */
+func (q *uploadQueue) wait(ctx context.Context) error {
+	if q == nil {
+		return nil
+	}
+	stop := context.AfterFunc(ctx, func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		q.changed.Broadcast()
+	})
+	defer stop()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for q.bytes > q.budget && !q.closed {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		q.changed.Wait()
+	}
+	return nil
+}
+
+/* block until all queued uploads are done */
+func (q *uploadQueue) drain(ctx context.Context) error {
+	if q == nil {
+		return nil
+	}
+	stop := context.AfterFunc(ctx, func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		q.changed.Broadcast()
+	})
+	defer stop()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.waiting)+q.running != 0 && !q.closed {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		q.changed.Wait()
+	}
+	return nil
+}
+
+/* stop workers, returns number of jobs left in queue */
+func (q *uploadQueue) close() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.changed.Broadcast()
+	return len(q.waiting)
+}
+
+/* files and bytes waiting for upload or being uploaded */
+func (fs *Ss3fs) UploadQueue() (files int, bytes int64) {
+	if fs.uploads == nil {
+		return 0, 0
+	}
+	fs.uploads.lock.Lock()
+	defer fs.uploads.lock.Unlock()
+	return len(fs.uploads.waiting) + fs.uploads.running, fs.uploads.bytes
+}
+
+/* Sync waits until closed files are uploaded, failed ones are retried later */
+func (fs *Ss3fs) Sync(ctx context.Context) error {
+	return fs.uploads.drain(ctx)
+}
+
+func (fs *Ss3fs) startUploads(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				job, ok := fs.uploads.next()
+				if !ok {
+					return
+				}
+				fs.runUpload(job)
+				fs.uploads.done(job)
+			}
+		}()
+	}
+}
+
+/* queue upload of staged file, false if updates aren't accepted now */
+func (fs *Ss3fs) queueUpload(name string, size int64) bool {
+	/* shutdown waits for queued uploads */
+	if !fs.beginUpdate() {
+		return false
+	}
+	if !fs.uploads.add(uploadJob{name: name, size: size}) {
+		fs.endUpdate()
+	}
+	return true
+}
+
+/* upload errors, that retries won't fix, e.g. AccessDenied or EntityTooLarge */
+var permanentUploadErrnos = map[int]bool{
+	fuse.EACCES:       true,
+	fuse.EFBIG:        true,
+	fuse.ENAMETOOLONG: true,
+	fuse.ENODEV:       true,
+	fuse.ENOTSUP:      true,
+	fuse.EINVAL:       true,
+}
+
+func (fs *Ss3fs) runUpload(job uploadJob) {
+	defer fs.endUpdate()
+	defer fs.paths.wlock(job.name)()
+	sf := fs.findStaged(job.name)
+	if sf == nil {
+		/* removed or uploaded by fsync meanwhile */
+		return
+	}
+	log := fs.log.With("key", job.name)
+	ctx, cancel := context.WithCancel(fs.ctx)
+	if fs.opts.DataTimeout > 0 {
+		ctx, cancel = context.WithTimeout(fs.ctx, fs.opts.DataTimeout)
+	}
+	defer cancel()
+	start := time.Now()
+	/* close returned already, conflicting changes are saved as sibling */
+	err := fs.flushStaged(ctx, sf, false)
+	if err != nil && permanentUploadErrnos[-errno(err)] {
+		/* file stays staged and journaled, next close or fsync tries again */
+		log.Error("queued upload failed, giving up", "err", err, "errno", -errno(err))
+		fs.metrics.addUploadFailure()
+		return
+	}
+	if err != nil {
+		/* file stays staged and journaled, it is tried again later */
+		log.Error("queued upload failed", "err", err, "errno", -errno(err))
+		/* retry is pending update, registered before this one ends, */
+		/* so shutdown waits for it */
+		fs.continueUpdate()
+		time.AfterFunc(max(fs.opts.Retry.MaxBackoff, time.Second), func() {
+			/* queued job ends the update */
+			if fs.ctx.Err() != nil || !fs.uploads.add(job) {
+				fs.endUpdate()
+			}
+		})
+		return
+	}
+	log.Debug("queued upload done", "size", job.size, "duration", time.Since(start))
+	fs.lock.Lock()
+	_, open := fs.opened[job.name]
+	fs.lock.Unlock()
+	if !open {
+		fs.dropStaged(job.name, sf)
+	}
+}
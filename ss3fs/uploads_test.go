@@ -0,0 +1,214 @@
+package ss3fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func newQueueFs(t *testing.T, mem *MemStore, latency time.Duration, workers int, budget int64) *Ss3fs {
+	opts := DefaultOptions()
+	opts.Faults = &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"Put"}, Key: "slow*", Latency: FaultDuration(latency)},
+	}}
+	opts.UploadWorkers = workers
+	opts.UploadBudget = budget
+	/* under fail, close uploads at once */
+	opts.Conflict = ConflictSibling
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Fatalf("Can't create file system, error: %v\n", err)
+	}
+	t.Cleanup(fs.Destroy)
+	return fs
+}
+
+/* write existing file through open handle and close it */
+func writeClosed(fs *Ss3fs, path string, data []byte) int {
+	_, fh := fs.Open(path, fuse.O_RDWR)
+	if n := fs.Write(path, data, 0, fh); n != len(data) {
+		return n
+	}
+	return fs.Release(path, fh)
+}
+
+func TestUploadQueueParallel(t *testing.T) {
+	mem := NewMemStore()
+	fs := newQueueFs(t, mem, 200*time.Millisecond, 4, 1<<20)
+	for i := 0; i < 8; i++ {
+		mem.Put(context.Background(), fmt.Sprintf("slow%d", i), emptyBody(), 0, nil, Condition{})
+	}
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		if errc := writeClosed(fs, fmt.Sprintf("/slow%d", i), []byte("data")); errc != 0 {
+			t.Errorf("Write and close failed with %d\n", errc)
+			return
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("Close waited for upload, took %v\n", elapsed)
+	}
+	if files, bytes := fs.UploadQueue(); files != 8 || bytes != 32 {
+		t.Errorf("Queue has %d files, %d bytes, want 8 and 32\n", files, bytes)
+	}
+	if err := fs.Sync(context.Background()); err != nil {
+		t.Errorf("Sync failed, error: %v\n", err)
+	}
+	/* two rounds of four workers */
+	if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+		t.Errorf("Uploads didn't run in parallel, took %v\n", elapsed)
+	}
+	for i := 0; i < 8; i++ {
+		if data := storeContent(t, mem, fmt.Sprintf("slow%d", i)); string(data) != "data" {
+			t.Errorf("Wrong uploaded content %q\n", data)
+		}
+	}
+}
+
+func TestUploadQueueBackpressure(t *testing.T) {
+	mem := NewMemStore()
+	fs := newQueueFs(t, mem, 300*time.Millisecond, 1, 10)
+	mem.Put(context.Background(), "slow", emptyBody(), 0, nil, Condition{})
+	mem.Put(context.Background(), "fast", emptyBody(), 0, nil, Condition{})
+	if errc := writeClosed(fs, "/slow", make([]byte, 20)); errc != 0 {
+		t.Errorf("Write and close failed with %d\n", errc)
+		return
+	}
+	/* budget is used up until the slow upload is done */
+	start := time.Now()
+	if errc := writeClosed(fs, "/fast", []byte("data")); errc != 0 {
+		t.Errorf("Write and close failed with %d\n", errc)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Writer didn't wait for queue over budget, took %v\n", elapsed)
+	}
+}
+
+func TestShutdownDrainsUploadQueue(t *testing.T) {
+	mem := NewMemStore()
+	fs := newQueueFs(t, mem, 100*time.Millisecond, 2, 1<<20)
+	mem.Put(context.Background(), "slow", emptyBody(), 0, nil, Condition{})
+	writeClosed(fs, "/slow", []byte("data"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := fs.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed, error: %v\n", err)
+	}
+	if data := storeContent(t, mem, "slow"); string(data) != "data" {
+		t.Errorf("Queued upload was lost on shutdown %q\n", data)
+	}
+}
+
+/* shutdown waits for retry of failed upload, and reports changes left */
+func TestShutdownWaitsForRetry(t *testing.T) {
+	mem := NewMemStore()
+	opts := DefaultOptions()
+	opts.Conflict = ConflictSibling
+	opts.Faults = &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"Put"}, Key: "failing", Error: "InternalError", Count: 1},
+	}}
+	opts.Retry.MaxAttempts = 1
+	opts.Retry.MaxBackoff = 100 * time.Millisecond
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	putString(mem, "failing", "")
+	putString(mem, "open", "")
+	writeClosed(fs, "/failing", []byte("data"))
+	_, fh := fs.Open("/open", fuse.O_RDWR)
+	fs.Write("/open", []byte("unflushed"), 0, fh)
+	fs.Sync(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := fs.Shutdown(ctx); !errors.Is(err, ErrChangesLeft) {
+		t.Errorf("Changes of open file weren't reported, error: %v\n", err)
+	}
+	if data := storeContent(t, mem, "failing"); string(data) != "data" {
+		t.Errorf("Retried upload was lost on shutdown %q\n", data)
+	}
+}
+
+/* upload denied for good isn't queued again, but its changes are kept */
+func TestPermanentUploadError(t *testing.T) {
+	mem := NewMemStore()
+	opts := DefaultOptions()
+	opts.Conflict = ConflictSibling
+	opts.Faults = &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"Put"}, Key: "denied", Error: "AccessDenied"},
+	}}
+	opts.Retry.MaxBackoff = 10 * time.Millisecond
+	opts.Metrics = NewMetrics(prometheus.NewRegistry())
+	opts.UnmountTimeout = 0
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	defer fs.Destroy()
+	putString(mem, "denied", "")
+	writeClosed(fs, "/denied", []byte("data"))
+	fs.Sync(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	if files, _ := fs.UploadQueue(); files != 0 {
+		t.Errorf("Denied upload was queued again, %d files in queue\n", files)
+	}
+	if v := testutil.ToFloat64(opts.Metrics.uploadFailures); v != 1 {
+		t.Errorf("Wrong upload failures count %v\n", v)
+	}
+	if fs.dirtyStaged() != 1 {
+		t.Errorf("Changes of denied upload were dropped\n")
+	}
+}
+
+/* unmount uploads queued files before it cancels store calls, */
+/* and reports changes it gave up on */
+func TestDestroyDrainsUploadQueue(t *testing.T) {
+	mem := NewMemStore()
+	opts := DefaultOptions()
+	opts.Conflict = ConflictSibling
+	opts.Faults = &FaultConfig{Rules: []*FaultRule{
+		{Ops: []string{"Put"}, Key: "slow", Latency: FaultDuration(100 * time.Millisecond)},
+		{Ops: []string{"Put"}, Key: "failing", Error: "InternalError"},
+	}}
+	opts.Retry.MaxAttempts = 1
+	opts.UnmountTimeout = time.Second
+	fs, err := NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	putString(mem, "slow", "")
+	writeClosed(fs, "/slow", []byte("data"))
+	fs.Destroy()
+	if data := storeContent(t, mem, "slow"); string(data) != "data" {
+		t.Errorf("Queued upload was lost on unmount %q\n", data)
+	}
+	if fs.ChangesLost() {
+		t.Errorf("Unmount reported lost changes after all uploads\n")
+	}
+
+	fs, err = NewSs3fsWithStore(mem, opts)
+	if err != nil {
+		t.Errorf("Can't create file system, error: %v\n", err)
+		return
+	}
+	putString(mem, "failing", "")
+	writeClosed(fs, "/failing", []byte("data"))
+	start := time.Now()
+	fs.Destroy()
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Unmount didn't stop at timeout, took %v\n", elapsed)
+	}
+	if !fs.ChangesLost() {
+		t.Errorf("Unmount didn't report failing upload\n")
+	}
+}